@@ -1,16 +1,25 @@
 package graval
 
 import (
+	"context"
 	"fmt"
 	"github.com/jehiah/go-strftime"
+	"io"
+	"net"
+	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type ftpCommand interface {
 	RequireParam() bool
 	RequireAuth() bool
+	// Syntax describes the params the command accepts for HELP, in the style
+	// used by RFC 959. Returns an empty string if there are no params.
+	Syntax() string
 	Execute(*ftpConn, string)
 }
 
@@ -18,30 +27,41 @@ type commandMap map[string]ftpCommand
 
 var (
 	commands = commandMap{
+		"ABOR": commandAbor{},
 		"ALLO": commandAllo{},
+		"APPE": commandAppe{},
+		"AUTH": commandAuth{},
 		"CDUP": commandCdup{},
 		"CWD":  commandCwd{},
 		"DELE": commandDele{},
 		"EPRT": commandEprt{},
 		"EPSV": commandEpsv{},
 		"FEAT": commandFeat{},
+		"HELP": commandHelp{},
 		"LIST": commandList{},
 		"NLST": commandNlst{},
 		"MDTM": commandMdtm{},
 		"MKD":  commandMkd{},
+		"MLSD": commandMlsd{},
+		"MLST": commandMlst{},
 		"MODE": commandMode{},
 		"NOOP": commandNoop{},
 		"OPTS": commandOpts{},
 		"PASS": commandPass{},
 		"PASV": commandPasv{},
+		"PBSZ": commandPbsz{},
 		"PORT": commandPort{},
+		"PROT": commandProt{},
 		"PWD":  commandPwd{},
 		"QUIT": commandQuit{},
+		"REST": commandRest{},
 		"RETR": commandRetr{},
 		"RNFR": commandRnfr{},
 		"RNTO": commandRnto{},
 		"RMD":  commandRmd{},
+		"SITE": commandSite{},
 		"SIZE": commandSize{},
+		"STAT": commandStat{},
 		"STOR": commandStor{},
 		"STRU": commandStru{},
 		"SYST": commandSyst{},
@@ -53,11 +73,53 @@ var (
 		"XRMD": commandRmd{},
 	}
 
+	// These commands can be processed while a data transfer is in progress. All
+	// other commands will wait until the transfer has finished.
+	concurrentCommands = map[string]bool{
+		"ABOR": true,
+		"NOOP": true,
+		"STAT": true,
+	}
+
 	// Some FTP clients send flags to the LIST and NLST commands. Server support for these varies,
 	// and implementing them all would be a lot of work with uncertain payoff. For now, we ignore them
 	listFlagsRegexp = `^-[alt]+$`
 )
 
+// commandAbor responds to the ABOR FTP command.
+//
+// The client wants to cancel the data transfer that is in progress. The
+// transfer replies with 426 once it has stopped, then we confirm the abort
+// with 226, as described in RFC 959.
+type commandAbor struct{}
+
+func (cmd commandAbor) RequireParam() bool {
+	return false
+}
+
+func (cmd commandAbor) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandAbor) Syntax() string {
+	return ""
+}
+
+func (cmd commandAbor) Execute(conn *ftpConn, param string) {
+	transfer := conn.currentTransfer()
+	if transfer == nil {
+		if conn.dataConn != nil {
+			conn.dataConn.Close()
+			conn.dataConn = nil
+		}
+		conn.writeMessage(225, "No transfer to abort")
+		return
+	}
+	transfer.Abort()
+	transfer.Wait()
+	conn.writeMessage(226, "Abort successful")
+}
+
 // commandAllo responds to the ALLO FTP command.
 //
 // This is essentially a ping from the client so we just respond with an
@@ -72,10 +134,87 @@ func (cmd commandAllo) RequireAuth() bool {
 	return false
 }
 
+func (cmd commandAllo) Syntax() string {
+	return "<sp> size"
+}
+
 func (cmd commandAllo) Execute(conn *ftpConn, param string) {
 	conn.writeMessage(202, "Obsolete")
 }
 
+// commandAppe responds to the APPE FTP command. It allows the client to
+// upload data that will be appended to an existing file, or create a new
+// file if it doesn't exist yet.
+type commandAppe struct{}
+
+func (cmd commandAppe) RequireParam() bool {
+	return true
+}
+
+func (cmd commandAppe) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandAppe) Syntax() string {
+	return "<sp> pathname"
+}
+
+func (cmd commandAppe) Execute(conn *ftpConn, param string) {
+	appendFile := appender(conn.driver)
+	if appendFile == nil {
+		conn.writeMessage(502, "APPE not supported")
+		return
+	}
+	if !conn.checkDataProtection() {
+		return
+	}
+	targetPath := conn.buildPath(param)
+	conn.writeMessage(150, "Data transfer starting")
+	conn.receiveOutofbandReader(func(ctx context.Context, reader io.Reader) error {
+		return appendFile(ctx, targetPath, reader)
+	})
+}
+
+// commandAuth responds to the AUTH FTP command.
+//
+// The client is requesting that the control connection be upgraded to TLS,
+// as described in RFC 4217. Only available when the server has been
+// configured with a TLS config.
+type commandAuth struct{}
+
+func (cmd commandAuth) RequireParam() bool {
+	return true
+}
+
+func (cmd commandAuth) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandAuth) Syntax() string {
+	return "<sp> mechanism"
+}
+
+func (cmd commandAuth) Execute(conn *ftpConn, param string) {
+	if conn.server.tlsConfig == nil {
+		conn.writeMessage(502, "TLS is not configured")
+		return
+	}
+	if conn.tlsEnabled {
+		conn.writeMessage(503, "Already using TLS")
+		return
+	}
+	mechanism := strings.ToUpper(param)
+	if mechanism != "TLS" && mechanism != "TLS-C" && mechanism != "SSL" {
+		conn.writeMessage(504, "AUTH type not supported, use TLS")
+		return
+	}
+	conn.writeMessage(234, "AUTH command OK. Initializing TLS connection.")
+	if err := conn.upgradeToTLS(); err != nil {
+		conn.logger.Printf("TLS handshake failed: %s", err)
+		conn.Close()
+	}
+}
+
 // commandCdup responds to the CDUP FTP command.
 //
 // Allows the client change their current directory to the parent.
@@ -89,6 +228,10 @@ func (cmd commandCdup) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandCdup) Syntax() string {
+	return ""
+}
+
 func (cmd commandCdup) Execute(conn *ftpConn, param string) {
 	otherCmd := &commandCwd{}
 	otherCmd.Execute(conn, "..")
@@ -106,13 +249,17 @@ func (cmd commandCwd) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandCwd) Syntax() string {
+	return "<sp> pathname"
+}
+
 func (cmd commandCwd) Execute(conn *ftpConn, param string) {
 	path := conn.buildPath(param)
-	if conn.driver.ChangeDir(path) {
+	if err := conn.driver.ChangeDir(conn.ctx, path); err == nil {
 		conn.namePrefix = path
 		conn.writeMessage(250, "Directory changed to "+path)
 	} else {
-		conn.writeMessage(550, "Action not taken")
+		conn.writeError(err, 550, "Action not taken")
 	}
 }
 
@@ -128,12 +275,16 @@ func (cmd commandDele) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandDele) Syntax() string {
+	return "<sp> pathname"
+}
+
 func (cmd commandDele) Execute(conn *ftpConn, param string) {
 	path := conn.buildPath(param)
-	if conn.driver.DeleteFile(path) {
+	if err := conn.driver.DeleteFile(conn.ctx, path); err == nil {
 		conn.writeMessage(250, "File deleted")
 	} else {
-		conn.writeMessage(550, "Action not taken")
+		conn.writeError(err, 550, "Action not taken")
 	}
 }
 
@@ -150,19 +301,27 @@ func (cmd commandEprt) RequireAuth() bool {
 	return true
 }
 
-func (cmd commandEprt) Execute(conn *ftpConn, param string) {
-	delim := string(param[0:1])
-	parts := strings.Split(param, delim)
-	addressFamily, err := strconv.Atoi(parts[1])
-	host := parts[2]
-	port, err := strconv.Atoi(parts[3])
+func (cmd commandEprt) Syntax() string {
+	return "<sp> |protocol|address|port|"
+}
 
-	if addressFamily != 1 && addressFamily != 2 {
+func (cmd commandEprt) Execute(conn *ftpConn, param string) {
+	if !conn.checkNotEpsvAll() {
+		return
+	}
+	_, ip, port, err := parseEprtArgs(param)
+	if err == errUnsupportedProtocol {
 		conn.writeMessage(522, "Network protocol not supported, use (1,2)")
 		return
+	} else if err != nil {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
+	if !conn.checkActiveTarget(ip, port) {
+		return
 	}
 
-	_, err = conn.newActiveSocket(host, port)
+	_, err = conn.newActiveSocket(ip.String(), port)
 
 	if err != nil {
 		conn.writeMessage(425, "Data connection failed")
@@ -173,7 +332,13 @@ func (cmd commandEprt) Execute(conn *ftpConn, param string) {
 
 // commandEpsv responds to the EPSV FTP command. It allows the client to
 // request a passive data socket with more options than the original PASV
-// command. It mainly adds ipv6 support, although we don't support that yet.
+// command. It mainly adds ipv6 support.
+//
+// The client may name the network protocol it wants to use, 1 for IPv4 or 2
+// for IPv6. The data socket always listens on the address the control
+// connection arrived on, so only that protocol is supported. "EPSV ALL"
+// tells us the client will only use EPSV from now on, so NAT devices can stop
+// rewriting PORT and PASV commands.
 type commandEpsv struct{}
 
 func (cmd commandEpsv) RequireParam() bool {
@@ -184,10 +349,30 @@ func (cmd commandEpsv) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandEpsv) Syntax() string {
+	return "[<sp> protocol | ALL]"
+}
+
 func (cmd commandEpsv) Execute(conn *ftpConn, param string) {
+	if strings.ToUpper(param) == "ALL" {
+		conn.epsvAll = true
+		conn.writeMessage(200, "EPSV ALL ok, only EPSV will be accepted")
+		return
+	}
+	if param != "" {
+		family, err := strconv.Atoi(param)
+		if err != nil {
+			conn.writeMessage(501, "Syntax error in parameters or arguments")
+			return
+		}
+		if family != conn.networkProtocol() {
+			conn.writeMessage(522, fmt.Sprintf("Network protocol not supported, use (%d)", conn.networkProtocol()))
+			return
+		}
+	}
 	socket, err := conn.newPassiveSocket()
 	if err != nil {
-		conn.writeMessage(425, "Data connection failed")
+		conn.writePassiveError(err)
 		return
 	}
 	msg := fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", socket.Port())
@@ -207,16 +392,79 @@ func (cmd commandFeat) RequireAuth() bool {
 	return false
 }
 
+func (cmd commandFeat) Syntax() string {
+	return ""
+}
+
 func (cmd commandFeat) Execute(conn *ftpConn, param string) {
-	conn.writeLines(211,
-		"211-Features supported:",
-		" EPRT",
-		" EPSV",
-		" MDTM",
-		" SIZE",
-		" UTF8",
-		"211 End FEAT.",
-	)
+	tlsAvailable := conn.server.tlsConfig != nil
+	lines := []string{"211-Features supported:"}
+	if tlsAvailable && !conn.server.implicitTLS {
+		lines = append(lines, " AUTH TLS")
+	}
+	lines = append(lines, " EPRT", " EPSV", " MDTM", " MLST "+mlstFeature(conn.mlstFacts))
+	if tlsAvailable {
+		lines = append(lines, " PBSZ", " PROT")
+	}
+	lines = append(lines, " REST STREAM", " SIZE", " UTF8", "211 End FEAT.")
+	conn.writeLines(211, lines...)
+}
+
+// commandHelp responds to the HELP FTP command.
+//
+// Without a param it lists the commands we support, with a param it describes
+// the syntax of a single command.
+type commandHelp struct{}
+
+func (cmd commandHelp) RequireParam() bool {
+	return false
+}
+
+func (cmd commandHelp) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandHelp) Syntax() string {
+	return "[<sp> command]"
+}
+
+func (cmd commandHelp) Execute(conn *ftpConn, param string) {
+	if param != "" {
+		name := strings.ToUpper(param)
+		cmdObj := conn.server.commands[name]
+		if cmdObj == nil {
+			conn.writeMessage(502, "Unknown command "+name)
+			return
+		}
+		conn.writeMessage(214, strings.TrimSpace("Syntax: "+name+" "+cmdObj.Syntax()))
+		return
+	}
+
+	lines := []string{"214-The following commands are recognized:"}
+	lines = append(lines, commandNames(conn.server.commands)...)
+	lines = append(lines, "214 Help OK.")
+	conn.writeLines(214, lines...)
+}
+
+// commandNames lists the names of the commands in cmds, sorted and with 8 per
+// line, in the format used for the HELP command.
+func commandNames(cmds commandMap) []string {
+	names := make([]string, 0, len(cmds))
+	for name := range cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{}
+	line := ""
+	for i, name := range names {
+		line += fmt.Sprintf(" %-4s", name)
+		if (i+1)%8 == 0 || i == len(names)-1 {
+			lines = append(lines, line)
+			line = ""
+		}
+	}
+	return lines
 }
 
 // commandList responds to the LIST FTP command. It allows the client to retreive
@@ -231,14 +479,25 @@ func (cmd commandList) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandList) Syntax() string {
+	return "[<sp> pathname]"
+}
+
 func (cmd commandList) Execute(conn *ftpConn, param string) {
-	conn.writeMessage(150, "Opening ASCII mode data connection for file list")
+	if !conn.checkDataProtection() {
+		return
+	}
 	matched, _ := regexp.MatchString(listFlagsRegexp, param)
 	if matched {
 		param = ""
 	}
 	path := conn.buildPath(param)
-	files := conn.driver.DirContents(path)
+	files, err := conn.driver.DirContents(conn.ctx, path)
+	if err != nil {
+		conn.writeError(err, 550, "Directory not available")
+		return
+	}
+	conn.writeMessage(150, "Opening ASCII mode data connection for file list")
 	formatter := newListFormatter(files)
 	conn.sendOutofbandData(formatter.Detailed())
 }
@@ -255,14 +514,25 @@ func (cmd commandNlst) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandNlst) Syntax() string {
+	return "[<sp> pathname]"
+}
+
 func (cmd commandNlst) Execute(conn *ftpConn, param string) {
-	conn.writeMessage(150, "Opening ASCII mode data connection for file list")
+	if !conn.checkDataProtection() {
+		return
+	}
 	matched, _ := regexp.MatchString(listFlagsRegexp, param)
 	if matched {
 		param = ""
 	}
 	path := conn.buildPath(param)
-	files := conn.driver.DirContents(path)
+	files, err := conn.driver.DirContents(conn.ctx, path)
+	if err != nil {
+		conn.writeError(err, 550, "Directory not available")
+		return
+	}
+	conn.writeMessage(150, "Opening ASCII mode data connection for file list")
 	formatter := newListFormatter(files)
 	conn.sendOutofbandData(formatter.Short())
 }
@@ -279,13 +549,17 @@ func (cmd commandMdtm) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandMdtm) Syntax() string {
+	return "<sp> pathname"
+}
+
 func (cmd commandMdtm) Execute(conn *ftpConn, param string) {
 	path := conn.buildPath(param)
-	time, err := conn.driver.ModifiedTime(path)
+	time, err := conn.driver.ModifiedTime(conn.ctx, path)
 	if err == nil {
 		conn.writeMessage(213, strftime.Format("%Y%m%d%H%M%S", time))
 	} else {
-		conn.writeMessage(450, "File not available")
+		conn.writeError(err, 450, "File not available")
 	}
 }
 
@@ -301,15 +575,83 @@ func (cmd commandMkd) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandMkd) Syntax() string {
+	return "<sp> pathname"
+}
+
 func (cmd commandMkd) Execute(conn *ftpConn, param string) {
 	path := conn.buildPath(param)
-	if conn.driver.MakeDir(path) {
+	if err := conn.driver.MakeDir(conn.ctx, path); err == nil {
 		conn.writeMessage(257, "Directory created")
 	} else {
-		conn.writeMessage(550, "Action not taken")
+		conn.writeError(err, 550, "Action not taken")
 	}
 }
 
+// commandMlsd responds to the MLSD FTP command. It allows the client to
+// retreive a listing of the contents of a directory in the machine readable
+// format defined in RFC 3659.
+type commandMlsd struct{}
+
+func (cmd commandMlsd) RequireParam() bool {
+	return false
+}
+
+func (cmd commandMlsd) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMlsd) Syntax() string {
+	return "[<sp> pathname]"
+}
+
+func (cmd commandMlsd) Execute(conn *ftpConn, param string) {
+	if !conn.checkDataProtection() {
+		return
+	}
+	path := conn.buildPath(param)
+	files, err := conn.driver.DirContents(conn.ctx, path)
+	if err != nil {
+		conn.writeError(err, 550, "Directory not available")
+		return
+	}
+	conn.writeMessage(150, "Opening ASCII mode data connection for file list")
+	formatter := newListFormatter(files)
+	conn.sendOutofbandData(formatter.Machine(path, conn.mlstFacts))
+}
+
+// commandMlst responds to the MLST FTP command. It allows the client to
+// retreive details of a single file or directory in the machine readable
+// format defined in RFC 3659. The details are sent over the control
+// connection.
+type commandMlst struct{}
+
+func (cmd commandMlst) RequireParam() bool {
+	return false
+}
+
+func (cmd commandMlst) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMlst) Syntax() string {
+	return "[<sp> pathname]"
+}
+
+func (cmd commandMlst) Execute(conn *ftpConn, param string) {
+	path := conn.buildPath(param)
+	file := conn.statPath(path)
+	if file == nil {
+		conn.writeMessage(550, "File not available")
+		return
+	}
+	conn.writeLines(250,
+		"250-Listing "+path,
+		" "+mlsxEntry(file, path, conn.mlstFacts)+" "+path,
+		"250 End",
+	)
+}
+
 // commandMode responds to the MODE FTP command.
 //
 // the original FTP spec had various options for hosts to negotiate how data
@@ -326,6 +668,10 @@ func (cmd commandMode) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandMode) Syntax() string {
+	return "<sp> mode-code"
+}
+
 func (cmd commandMode) Execute(conn *ftpConn, param string) {
 	if strings.ToUpper(param) == "S" {
 		conn.writeMessage(200, "OK")
@@ -348,14 +694,18 @@ func (cmd commandNoop) RequireAuth() bool {
 	return false
 }
 
+func (cmd commandNoop) Syntax() string {
+	return ""
+}
+
 func (cmd commandNoop) Execute(conn *ftpConn, param string) {
 	conn.writeMessage(200, "OK")
 }
 
 // commandOpts responds to the OPTS FTP command.
 //
-// This is essentially a ping from the client so we just respond with an
-// basic 200 message.
+// Clients use this to enable UTF8, which we always use anyway, and to select
+// the facts they're interested in for MLSD and MLST listings.
 type commandOpts struct{}
 
 func (cmd commandOpts) RequireParam() bool {
@@ -366,12 +716,31 @@ func (cmd commandOpts) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandOpts) Syntax() string {
+	return "<sp> command [<sp> options]"
+}
+
 func (cmd commandOpts) Execute(conn *ftpConn, param string) {
 	if param == "UTF8 ON" || param == "UTF8" {
 		conn.writeMessage(200, "OK")
 		return
 	}
 
+	parts := strings.SplitN(param, " ", 2)
+	if strings.ToUpper(parts[0]) == "MLST" {
+		requested := ""
+		if len(parts) == 2 {
+			requested = parts[1]
+		}
+		conn.mlstFacts = selectMlsxFacts(requested)
+		msg := "MLST OPTS"
+		if len(conn.mlstFacts) > 0 {
+			msg += " " + strings.Join(conn.mlstFacts, ";") + ";"
+		}
+		conn.writeMessage(200, msg)
+		return
+	}
+
 	conn.writeMessage(500, "Command not found")
 }
 
@@ -387,12 +756,47 @@ func (cmd commandPass) RequireAuth() bool {
 	return false
 }
 
+func (cmd commandPass) Syntax() string {
+	return "<sp> password"
+}
+
 func (cmd commandPass) Execute(conn *ftpConn, param string) {
-	if conn.driver.Authenticate(conn.reqUser, param) {
+	if conn.server.requireTLSForAuth && !conn.tlsEnabled {
+		conn.writeMessage(530, "Not logged in, TLS required")
+		return
+	}
+	limiter := conn.server.loginLimiter
+	if limiter != nil {
+		delay, ok := limiter.Check(conn.remoteIP(), conn.reqUser)
+		if !ok {
+			conn.writeMessage(421, "Too many failed login attempts, try again later")
+			conn.Close()
+			return
+		}
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-conn.ctx.Done():
+				return
+			}
+		}
+	}
+	err := conn.driver.Authenticate(conn.ctx, conn.reqUser, param)
+	if list := conn.server.userAccessLists[conn.reqUser]; err == nil && list != nil && !list.Allowed(conn.remoteIP()) {
+		conn.logger.Printf("%s isn't allowed to log in from %s", conn.reqUser, conn.remoteIP())
+		err = ErrPermissionDenied
+	}
+	if err == nil {
+		if limiter != nil {
+			limiter.Success(conn.remoteIP(), conn.reqUser)
+		}
 		conn.user = conn.reqUser
 		conn.reqUser = ""
 		conn.writeMessage(230, "Password ok, continue")
 	} else {
+		if limiter != nil {
+			limiter.Failure(conn.remoteIP(), conn.reqUser)
+		}
 		conn.writeMessage(530, "Incorrect password, not logged in")
 		conn.writeMessage(221, "Goodbye.")
 		conn.Close()
@@ -413,28 +817,68 @@ func (cmd commandPasv) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandPasv) Syntax() string {
+	return ""
+}
+
 func (cmd commandPasv) Execute(conn *ftpConn, param string) {
-	socket, err := conn.newPassiveSocket()
-	if err != nil {
-		conn.writeMessage(425, "Data connection failed")
+	if !conn.checkNotEpsvAll() {
 		return
 	}
 
-	p1 := socket.Port() / 256
-	p2 := socket.Port() - (p1 * 256)
-
 	// if the server has been configured to send a specific IP for clients to connect to, use it. Otherwise
 	// fallback to the IP that the passive port is listening on
-	host := conn.pasvAdvertisedIp
+	host := conn.server.pasvAddresses.Address(conn.remoteIP())
 	if host == "" {
-		host = socket.Host()
+		host = conn.localIP()
+	}
+	// PASV can only describe IPv4 addresses, IPv6 clients must use EPSV
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		conn.writeMessage(522, "Network protocol not supported, use EPSV")
+		return
+	}
+
+	socket, err := conn.newPassiveSocket()
+	if err != nil {
+		conn.writePassiveError(err)
+		return
 	}
-	quads := strings.Split(host, ".")
-	target := fmt.Sprintf("(%s,%s,%s,%s,%d,%d)", quads[0], quads[1], quads[2], quads[3], p1, p2)
+
+	p1 := socket.Port() / 256
+	p2 := socket.Port() - (p1 * 256)
+	target := fmt.Sprintf("(%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], p1, p2)
 	msg := "Entering Passive Mode " + target
 	conn.writeMessage(227, msg)
 }
 
+// commandPbsz responds to the PBSZ FTP command.
+//
+// RFC 2228 defines a protection buffer size, but it has no meaning for TLS
+// and RFC 4217 requires it to always be 0. Clients must send it before PROT.
+type commandPbsz struct{}
+
+func (cmd commandPbsz) RequireParam() bool {
+	return true
+}
+
+func (cmd commandPbsz) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandPbsz) Syntax() string {
+	return "<sp> size"
+}
+
+func (cmd commandPbsz) Execute(conn *ftpConn, param string) {
+	if !conn.tlsEnabled {
+		conn.writeMessage(503, "PBSZ requires a secure control connection")
+		return
+	}
+	conn.pbszSent = true
+	conn.writeMessage(200, "PBSZ=0")
+}
+
 // commandPort responds to the PORT FTP command.
 //
 // The client has opened a listening socket for sending out of band data and
@@ -449,14 +893,24 @@ func (cmd commandPort) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandPort) Syntax() string {
+	return "<sp> h1,h2,h3,h4,p1,p2"
+}
+
 func (cmd commandPort) Execute(conn *ftpConn, param string) {
-	nums := strings.Split(param, ",")
-	portOne, _ := strconv.Atoi(nums[4])
-	portTwo, _ := strconv.Atoi(nums[5])
-	port := (portOne * 256) + portTwo
-	host := nums[0] + "." + nums[1] + "." + nums[2] + "." + nums[3]
+	if !conn.checkNotEpsvAll() {
+		return
+	}
+	ip, port, err := parsePortArgs(param)
+	if err != nil {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
+	if !conn.checkActiveTarget(ip, port) {
+		return
+	}
 
-	_, err := conn.newActiveSocket(host, port)
+	_, err = conn.newActiveSocket(ip.String(), port)
 
 	if err != nil {
 		conn.writeMessage(425, "Data connection failed")
@@ -465,6 +919,44 @@ func (cmd commandPort) Execute(conn *ftpConn, param string) {
 	conn.writeMessage(200, fmt.Sprintf("Connection established (%d)", port))
 }
 
+// commandProt responds to the PROT FTP command.
+//
+// Allows the client to choose whether data connections are sent in the (C)lear
+// or are (P)rivate and protected with TLS. The (S)afe and (C)onfidential levels
+// from RFC 2228 have no meaning for TLS.
+type commandProt struct{}
+
+func (cmd commandProt) RequireParam() bool {
+	return true
+}
+
+func (cmd commandProt) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandProt) Syntax() string {
+	return "<sp> level"
+}
+
+func (cmd commandProt) Execute(conn *ftpConn, param string) {
+	if !conn.pbszSent {
+		conn.writeMessage(503, "PROT must be preceded by PBSZ")
+		return
+	}
+	switch strings.ToUpper(param) {
+	case "C":
+		conn.protectData = false
+		conn.writeMessage(200, "Protection level set to Clear")
+	case "P":
+		conn.protectData = true
+		conn.writeMessage(200, "Protection level set to Private")
+	case "S", "E":
+		conn.writeMessage(536, "Requested PROT level not supported by mechanism")
+	default:
+		conn.writeMessage(504, "Unknown PROT level")
+	}
+}
+
 // commandPwd responds to the PWD FTP command.
 //
 // Tells the client what the current working directory is.
@@ -478,6 +970,10 @@ func (cmd commandPwd) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandPwd) Syntax() string {
+	return ""
+}
+
 func (cmd commandPwd) Execute(conn *ftpConn, param string) {
 	conn.writeMessage(257, "\""+conn.namePrefix+"\" is the current directory")
 }
@@ -494,10 +990,43 @@ func (cmd commandQuit) RequireAuth() bool {
 	return false
 }
 
+func (cmd commandQuit) Syntax() string {
+	return ""
+}
+
 func (cmd commandQuit) Execute(conn *ftpConn, param string) {
 	conn.Close()
 }
 
+// commandRest responds to the REST FTP command.
+//
+// The client is asking for the next RETR or STOR to begin part way through
+// the file, usually to resume an interrupted transfer. Only stream mode
+// restarts are supported, as described in RFC 3659.
+type commandRest struct{}
+
+func (cmd commandRest) RequireParam() bool {
+	return true
+}
+
+func (cmd commandRest) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandRest) Syntax() string {
+	return "<sp> offset"
+}
+
+func (cmd commandRest) Execute(conn *ftpConn, param string) {
+	offset, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || offset < 0 {
+		conn.writeMessage(501, "Invalid restart position")
+		return
+	}
+	conn.restOffset = offset
+	conn.writeMessage(350, fmt.Sprintf("Restarting at %d. Send STOR or RETR to initiate transfer", offset))
+}
+
 // commandRetr responds to the RETR FTP command. It allows the client to
 // download a file.
 type commandRetr struct{}
@@ -510,15 +1039,25 @@ func (cmd commandRetr) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandRetr) Syntax() string {
+	return "<sp> pathname"
+}
+
 func (cmd commandRetr) Execute(conn *ftpConn, param string) {
+	if !conn.checkDataProtection() {
+		return
+	}
 	path := conn.buildPath(param)
-	reader, err := conn.driver.GetFile(path)
+	offset := conn.restOffset
+	conn.restOffset = 0
+	transfer := conn.newTransfer()
+	reader, skip, err := conn.getFile(transfer.ctx, path, offset)
 	if err == nil {
-		defer reader.Close()
 		conn.writeMessage(150, "Data connection open. Transfer starting.")
-		conn.sendOutofbandReader(reader)
+		conn.sendOutofbandReader(transfer, reader, skip)
 	} else {
-		conn.writeMessage(551, "File not available")
+		transfer.cancel()
+		conn.writeError(err, 551, "File not available")
 	}
 }
 
@@ -534,6 +1073,10 @@ func (cmd commandRnfr) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandRnfr) Syntax() string {
+	return "<sp> pathname"
+}
+
 func (cmd commandRnfr) Execute(conn *ftpConn, param string) {
 	conn.renameFrom = conn.buildPath(param)
 	conn.writeMessage(350, "Requested file action pending further information.")
@@ -551,6 +1094,10 @@ func (cmd commandRnto) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandRnto) Syntax() string {
+	return "<sp> pathname"
+}
+
 func (cmd commandRnto) Execute(conn *ftpConn, param string) {
 	if conn.renameFrom == "" {
 		conn.writeMessage(503, "Bad sequence of commands: use RNFR first.")
@@ -558,10 +1105,10 @@ func (cmd commandRnto) Execute(conn *ftpConn, param string) {
 	}
 
 	toPath := conn.buildPath(param)
-	if conn.driver.Rename(conn.renameFrom, toPath) {
+	if err := conn.driver.Rename(conn.ctx, conn.renameFrom, toPath); err == nil {
 		conn.writeMessage(250, "File renamed")
 	} else {
-		conn.writeMessage(550, "Action not taken")
+		conn.writeError(err, 550, "Action not taken")
 	}
 }
 
@@ -577,15 +1124,62 @@ func (cmd commandRmd) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandRmd) Syntax() string {
+	return "<sp> pathname"
+}
+
 func (cmd commandRmd) Execute(conn *ftpConn, param string) {
 	path := conn.buildPath(param)
-	if conn.driver.DeleteDir(path) {
+	if err := conn.driver.DeleteDir(conn.ctx, path); err == nil {
 		conn.writeMessage(250, "Directory deleted")
 	} else {
-		conn.writeMessage(550, "Action not taken")
+		conn.writeError(err, 550, "Action not taken")
 	}
 }
 
+// commandSite responds to the SITE FTP command.
+//
+// SITE provides access to server specific commands, like "SITE CHMOD". There
+// are no SITE commands built in, but they can be registered with
+// FTPServer.RegisterSiteCommand().
+type commandSite struct{}
+
+func (cmd commandSite) RequireParam() bool {
+	return true
+}
+
+func (cmd commandSite) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandSite) Syntax() string {
+	return "<sp> command [<sp> params]"
+}
+
+func (cmd commandSite) Execute(conn *ftpConn, param string) {
+	parts := strings.SplitN(param, " ", 2)
+	name := strings.ToUpper(parts[0])
+	siteParam := ""
+	if len(parts) == 2 {
+		siteParam = strings.TrimSpace(parts[1])
+	}
+
+	if name == "HELP" {
+		lines := []string{"214-The following SITE commands are recognized:"}
+		lines = append(lines, commandNames(conn.server.siteCommands)...)
+		lines = append(lines, "214 Help OK.")
+		conn.writeLines(214, lines...)
+		return
+	}
+
+	cmdObj := conn.server.siteCommands[name]
+	if cmdObj == nil {
+		conn.writeMessage(500, "Unknown SITE command")
+		return
+	}
+	conn.executeCommand(cmdObj, siteParam)
+}
+
 // commandSize responds to the SIZE FTP command. It returns the size of the
 // requested path in bytes.
 type commandSize struct{}
@@ -598,16 +1192,71 @@ func (cmd commandSize) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandSize) Syntax() string {
+	return "<sp> pathname"
+}
+
 func (cmd commandSize) Execute(conn *ftpConn, param string) {
 	path := conn.buildPath(param)
-	bytes := conn.driver.Bytes(path)
-	if bytes >= 0 {
+	bytes, err := conn.driver.Bytes(conn.ctx, path)
+	if err == nil {
 		conn.writeMessage(213, fmt.Sprintf("%d", bytes))
 	} else {
-		conn.writeMessage(450, "file not available")
+		conn.writeError(err, 450, "file not available")
 	}
 }
 
+// commandStat responds to the STAT FTP command.
+//
+// Without a param, or while a transfer is in progress, it describes the state
+// of the session. With a param, it lists the requested path like LIST, but
+// over the control connection.
+type commandStat struct{}
+
+func (cmd commandStat) RequireParam() bool {
+	return false
+}
+
+func (cmd commandStat) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandStat) Syntax() string {
+	return "[<sp> pathname]"
+}
+
+func (cmd commandStat) Execute(conn *ftpConn, param string) {
+	if param == "" || conn.currentTransfer() != nil {
+		lines := []string{"211-FTP server status:"}
+		for _, line := range conn.statusLines() {
+			lines = append(lines, " "+line)
+		}
+		lines = append(lines, "211 End of status")
+		conn.writeLines(211, lines...)
+		return
+	}
+
+	path := conn.buildPath(param)
+	files, err := conn.driver.DirContents(conn.ctx, path)
+	if err != nil || len(files) == 0 {
+		if file := conn.statPath(path); file != nil && !file.IsDir() {
+			files = []os.FileInfo{file}
+		} else if err != nil {
+			conn.writeError(err, 550, "File not available")
+			return
+		}
+	}
+	formatter := newListFormatter(files)
+	lines := []string{"213-Status of " + path + ":"}
+	for _, line := range strings.Split(formatter.Detailed(), "\r\n") {
+		if line != "" {
+			lines = append(lines, " "+line)
+		}
+	}
+	lines = append(lines, "213 End of status")
+	conn.writeLines(213, lines...)
+}
+
 // commandStor responds to the STOR FTP command. It allows the user to upload a
 // new file.
 type commandStor struct{}
@@ -620,14 +1269,25 @@ func (cmd commandStor) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandStor) Syntax() string {
+	return "<sp> pathname"
+}
+
 func (cmd commandStor) Execute(conn *ftpConn, param string) {
+	if !conn.checkDataProtection() {
+		return
+	}
 	targetPath := conn.buildPath(param)
-	conn.writeMessage(150, "Data transfer starting")
-	if ok := conn.driver.PutFile(targetPath, conn.dataConn); ok {
-		conn.writeMessage(226, "Transfer complete.")
-	} else {
-		conn.writeMessage(450, "error during transfer")
+	offset := conn.restOffset
+	conn.restOffset = 0
+	if offset > 0 && resumeWriter(conn.driver) == nil {
+		conn.writeMessage(554, "Restarting uploads is not supported")
+		return
 	}
+	conn.writeMessage(150, "Data transfer starting")
+	conn.receiveOutofbandReader(func(ctx context.Context, reader io.Reader) error {
+		return conn.putFile(ctx, targetPath, reader, offset)
+	})
 }
 
 // commandStru responds to the STRU FTP command.
@@ -649,6 +1309,10 @@ func (cmd commandStru) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandStru) Syntax() string {
+	return "<sp> structure-code"
+}
+
 func (cmd commandStru) Execute(conn *ftpConn, param string) {
 	if strings.ToUpper(param) == "F" {
 		conn.writeMessage(200, "OK")
@@ -668,6 +1332,10 @@ func (cmd commandSyst) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandSyst) Syntax() string {
+	return ""
+}
+
 func (cmd commandSyst) Execute(conn *ftpConn, param string) {
 	conn.writeMessage(215, "UNIX Type: L8")
 }
@@ -692,10 +1360,16 @@ func (cmd commandType) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandType) Syntax() string {
+	return "<sp> type-code"
+}
+
 func (cmd commandType) Execute(conn *ftpConn, param string) {
 	if strings.ToUpper(param) == "A" {
+		conn.transferType = "ASCII"
 		conn.writeMessage(200, "Type set to ASCII")
 	} else if strings.ToUpper(param) == "I" {
+		conn.transferType = "Binary"
 		conn.writeMessage(200, "Type set to binary")
 	} else {
 		conn.writeMessage(500, "Invalid type")
@@ -713,7 +1387,15 @@ func (cmd commandUser) RequireAuth() bool {
 	return false
 }
 
+func (cmd commandUser) Syntax() string {
+	return "<sp> username"
+}
+
 func (cmd commandUser) Execute(conn *ftpConn, param string) {
+	if conn.server.requireTLSForAuth && !conn.tlsEnabled {
+		conn.writeMessage(534, "Policy requires TLS, use AUTH TLS")
+		return
+	}
 	conn.reqUser = param
 	conn.writeMessage(331, "User name ok, password required")
 }
@@ -7,28 +7,39 @@ import (
 
 func TestStringMapsToCorrectCommands(t *testing.T) {
 	Convey("Command map calls correct objects", t, func() {
+		So(commands["ABOR"], ShouldHaveSameTypeAs, commandAbor{})
 		So(commands["ALLO"], ShouldHaveSameTypeAs, commandAllo{})
+		So(commands["APPE"], ShouldHaveSameTypeAs, commandAppe{})
+		So(commands["AUTH"], ShouldHaveSameTypeAs, commandAuth{})
 		So(commands["CDUP"], ShouldHaveSameTypeAs, commandCdup{})
 		So(commands["CWD"], ShouldHaveSameTypeAs, commandCwd{})
 		So(commands["DELE"], ShouldHaveSameTypeAs, commandDele{})
 		So(commands["EPRT"], ShouldHaveSameTypeAs, commandEprt{})
 		So(commands["EPSV"], ShouldHaveSameTypeAs, commandEpsv{})
+		So(commands["HELP"], ShouldHaveSameTypeAs, commandHelp{})
 		So(commands["LIST"], ShouldHaveSameTypeAs, commandList{})
 		So(commands["NLST"], ShouldHaveSameTypeAs, commandNlst{})
 		So(commands["MDTM"], ShouldHaveSameTypeAs, commandMdtm{})
 		So(commands["MKD"], ShouldHaveSameTypeAs, commandMkd{})
+		So(commands["MLSD"], ShouldHaveSameTypeAs, commandMlsd{})
+		So(commands["MLST"], ShouldHaveSameTypeAs, commandMlst{})
 		So(commands["MODE"], ShouldHaveSameTypeAs, commandMode{})
 		So(commands["NOOP"], ShouldHaveSameTypeAs, commandNoop{})
 		So(commands["PASS"], ShouldHaveSameTypeAs, commandPass{})
 		So(commands["PASV"], ShouldHaveSameTypeAs, commandPasv{})
+		So(commands["PBSZ"], ShouldHaveSameTypeAs, commandPbsz{})
 		So(commands["PORT"], ShouldHaveSameTypeAs, commandPort{})
+		So(commands["PROT"], ShouldHaveSameTypeAs, commandProt{})
 		So(commands["PWD"], ShouldHaveSameTypeAs, commandPwd{})
 		So(commands["QUIT"], ShouldHaveSameTypeAs, commandQuit{})
+		So(commands["REST"], ShouldHaveSameTypeAs, commandRest{})
 		So(commands["RETR"], ShouldHaveSameTypeAs, commandRetr{})
 		So(commands["RNFR"], ShouldHaveSameTypeAs, commandRnfr{})
 		So(commands["RNTO"], ShouldHaveSameTypeAs, commandRnto{})
 		So(commands["RMD"], ShouldHaveSameTypeAs, commandRmd{})
+		So(commands["SITE"], ShouldHaveSameTypeAs, commandSite{})
 		So(commands["SIZE"], ShouldHaveSameTypeAs, commandSize{})
+		So(commands["STAT"], ShouldHaveSameTypeAs, commandStat{})
 		So(commands["STOR"], ShouldHaveSameTypeAs, commandStor{})
 		So(commands["STRU"], ShouldHaveSameTypeAs, commandStru{})
 		So(commands["SYST"], ShouldHaveSameTypeAs, commandSyst{})
@@ -0,0 +1,102 @@
+package graval
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// errInvalidAddress is returned when the argument to PORT or EPRT can't be
+// parsed.
+var errInvalidAddress = errors.New("invalid address argument")
+
+// errUnsupportedProtocol is returned when EPRT names a network protocol other
+// than IPv4 or IPv6.
+var errUnsupportedProtocol = errors.New("unsupported network protocol")
+
+// parsePortArgs parses the argument to the PORT command, as defined in RFC
+// 959. It's six comma separated numbers, the four bytes of an IPv4 address
+// and the two bytes of a port number.
+//
+//     parsePortArgs("192,168,1,2,7,138")
+//     => 192.168.1.2, 1930
+//
+func parsePortArgs(param string) (net.IP, int, error) {
+	fields := strings.Split(param, ",")
+	if len(fields) != 6 {
+		return nil, 0, errInvalidAddress
+	}
+	var bytes [6]byte
+	for i, field := range fields {
+		value, ok := parseDecimal(strings.TrimSpace(field), 255)
+		if !ok {
+			return nil, 0, errInvalidAddress
+		}
+		bytes[i] = byte(value)
+	}
+	ip := net.IPv4(bytes[0], bytes[1], bytes[2], bytes[3])
+	port := int(bytes[4])<<8 | int(bytes[5])
+	return ip, port, nil
+}
+
+// parseEprtArgs parses the argument to the EPRT command, as defined in RFC
+// 2428. The first character is a delimiter that separates the network
+// protocol (1 for IPv4, 2 for IPv6), the address and the port.
+//
+//     parseEprtArgs("|1|132.235.1.2|6275|")
+//     => 1, 132.235.1.2, 6275
+//     parseEprtArgs("|2|1080::8:800:200C:417A|5282|")
+//     => 2, 1080::8:800:200c:417a, 5282
+//
+// errUnsupportedProtocol is returned for well formed arguments that name
+// another network protocol, so the client can be sent a 522 reply.
+func parseEprtArgs(param string) (int, net.IP, int, error) {
+	if len(param) < 1 || param[0] < 33 || param[0] > 126 {
+		return 0, nil, 0, errInvalidAddress
+	}
+	fields := strings.Split(param, param[0:1])
+	if len(fields) != 5 || fields[0] != "" || fields[4] != "" {
+		return 0, nil, 0, errInvalidAddress
+	}
+	protocol, ok := parseDecimal(fields[1], 255)
+	if !ok {
+		return 0, nil, 0, errInvalidAddress
+	}
+	port, ok := parseDecimal(fields[3], 65535)
+	if !ok {
+		return 0, nil, 0, errInvalidAddress
+	}
+	if protocol != 1 && protocol != 2 {
+		return protocol, nil, 0, errUnsupportedProtocol
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return 0, nil, 0, errInvalidAddress
+	}
+	// IPv4 addresses must be dotted decimal, IPv6 addresses must use IPv6
+	// notation, even if it's an IPv4 mapped address
+	isIPv6 := strings.Contains(fields[2], ":")
+	if (protocol == 1 && isIPv6) || (protocol == 2 && !isIPv6) {
+		return 0, nil, 0, errInvalidAddress
+	}
+	return protocol, ip, port, nil
+}
+
+// parseDecimal parses a non-negative decimal number no greater than max.
+// Unlike strconv.Atoi, signs and other decorations aren't accepted.
+func parseDecimal(s string, max int) (int, bool) {
+	if len(s) == 0 || len(s) > 5 {
+		return 0, false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	value, err := strconv.Atoi(s)
+	if err != nil || value > max {
+		return 0, false
+	}
+	return value, true
+}
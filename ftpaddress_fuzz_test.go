@@ -0,0 +1,58 @@
+//go:build go1.18
+// +build go1.18
+
+package graval
+
+// The fuzz targets are kept apart from the other tests because testing.F
+// requires Go 1.18.
+
+import (
+	"fmt"
+	"testing"
+)
+
+func FuzzParsePortArgs(f *testing.F) {
+	f.Add("192,168,1,2,7,138")
+	f.Add("1,2,3,4,5")
+	f.Fuzz(func(t *testing.T, param string) {
+		ip, port, err := parsePortArgs(param)
+		if err != nil {
+			return
+		}
+		ip4 := ip.To4()
+		if ip4 == nil || port < 0 || port > 65535 {
+			t.Fatalf("parsePortArgs(%q) returned %s, %d", param, ip, port)
+		}
+		formatted := fmt.Sprintf("%d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], port>>8, port&0xff)
+		ip2, port2, err := parsePortArgs(formatted)
+		if err != nil || !ip2.Equal(ip) || port2 != port {
+			t.Fatalf("parsePortArgs(%q) didn't round trip via %q", param, formatted)
+		}
+	})
+}
+
+func FuzzParseEprtArgs(f *testing.F) {
+	f.Add("|1|132.235.1.2|6275|")
+	f.Add("|2|1080::8:800:200C:417A|5282|")
+	f.Fuzz(func(t *testing.T, param string) {
+		protocol, ip, port, err := parseEprtArgs(param)
+		if err != nil {
+			return
+		}
+		if (protocol != 1 && protocol != 2) || ip == nil || port < 0 || port > 65535 {
+			t.Fatalf("parseEprtArgs(%q) returned %d, %s, %d", param, protocol, ip, port)
+		}
+		if protocol == 1 && ip.To4() == nil {
+			t.Fatalf("parseEprtArgs(%q) returned a non IPv4 address for protocol 1", param)
+		}
+		// IPv4 mapped IPv6 addresses are formatted as IPv4, so won't round trip
+		if protocol == 2 && ip.To4() != nil {
+			return
+		}
+		formatted := fmt.Sprintf("|%d|%s|%d|", protocol, ip, port)
+		protocol2, ip2, port2, err := parseEprtArgs(formatted)
+		if err != nil || protocol2 != protocol || !ip2.Equal(ip) || port2 != port {
+			t.Fatalf("parseEprtArgs(%q) didn't round trip via %q", param, formatted)
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestParsePortArgs(t *testing.T) {
+	Convey("Parses valid PORT arguments", t, func() {
+		ip, port, err := parsePortArgs("192,168,1,2,7,138")
+		So(err, ShouldBeNil)
+		So(ip.String(), ShouldEqual, "192.168.1.2")
+		So(port, ShouldEqual, 1930)
+	})
+
+	Convey("Rejects malformed PORT arguments", t, func() {
+		for _, param := range []string{"", "1,2,3,4,5", "1,2,3,4,5,6,7", "256,0,0,1,1,1", "1,2,3,4,5,-6", "1,2,3,4,+5,6", "a,b,c,d,e,f", "1,2,3,,5,6"} {
+			_, _, err := parsePortArgs(param)
+			So(err, ShouldEqual, errInvalidAddress)
+		}
+	})
+}
+
+func TestParseEprtArgs(t *testing.T) {
+	Convey("Parses valid EPRT arguments", t, func() {
+		protocol, ip, port, err := parseEprtArgs("|1|132.235.1.2|6275|")
+		So(err, ShouldBeNil)
+		So(protocol, ShouldEqual, 1)
+		So(ip.String(), ShouldEqual, "132.235.1.2")
+		So(port, ShouldEqual, 6275)
+
+		protocol, ip, port, err = parseEprtArgs("!2!1080::8:800:200C:417A!5282!")
+		So(err, ShouldBeNil)
+		So(protocol, ShouldEqual, 2)
+		So(ip.String(), ShouldEqual, "1080::8:800:200c:417a")
+		So(port, ShouldEqual, 5282)
+	})
+
+	Convey("Reports unsupported network protocols", t, func() {
+		protocol, _, _, err := parseEprtArgs("|3|foo|6275|")
+		So(err, ShouldEqual, errUnsupportedProtocol)
+		So(protocol, ShouldEqual, 3)
+	})
+
+	Convey("Rejects malformed EPRT arguments", t, func() {
+		for _, param := range []string{"", "|", "||||", "|1|132.235.1.2|6275", "|1|132.235.1.2|70000|", "|1|::1|6275|", "|2|10.0.0.1|6275|", "|1|132.235.1.2|6275|x", " 1 132.235.1.2 6275 ", "|x|132.235.1.2|6275|"} {
+			_, _, _, err := parseEprtArgs(param)
+			So(err, ShouldEqual, errInvalidAddress)
+		}
+	})
+}
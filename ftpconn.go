@@ -3,52 +3,80 @@ package graval
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type ftpConn struct {
-	conn             net.Conn
-	controlReader    *bufio.Reader
-	controlWriter    *bufio.Writer
-	dataConn         ftpDataSocket
-	driver           FTPDriver
-	logger           *ftpLogger
-	serverName       string
-	sessionId        string
-	namePrefix       string
-	reqUser          string
-	user             string
-	renameFrom       string
-	minDataPort      int
-	maxDataPort      int
-	pasvAdvertisedIp string
+	netConn       net.Conn
+	conn          net.Conn
+	controlReader *bufio.Reader
+	controlWriter *bufio.Writer
+	dataConn      ftpDataSocket
+	driver        FTPContextDriver
+	ctx           context.Context
+	cancel        context.CancelFunc
+	server        *FTPServer
+	logger        *ftpLogger
+	sessionId     string
+	namePrefix    string
+	reqUser       string
+	user          string
+	renameFrom    string
+	restOffset    int64
+	mlstFacts     []string
+	epsvAll       bool
+	tlsEnabled    bool
+	pbszSent      bool
+	protectData   bool
+	writeMutex    sync.Mutex
+	stateMutex    sync.Mutex
+	transfer      *ftpTransfer
+	busy          bool
+	closing       bool
+	command       string
+	transferType  string
+	bytesTotal    int64
 }
 
 // NewftpConn constructs a new object that will handle the FTP protocol over
 // an active net.TCPConn. The TCP connection should already be open before
-// it is handed to this functions. driver is an instance of FTPDriver that
-// will handle all auth and persistence details.
-func newftpConn(tcpConn net.Conn, driver FTPDriver, serverName string, minPort int, maxPort int, pasvAdvertisedIp string) *ftpConn {
+// it is handed to this functions. driver is an instance of FTPContextDriver
+// that will handle all auth and persistence details. server is the FTPServer that
+// accepted the connection, and provides the server wide configuration.
+func newftpConn(tcpConn net.Conn, driver FTPContextDriver, server *FTPServer) *ftpConn {
 	c := new(ftpConn)
 	c.namePrefix = "/"
+	c.netConn = tcpConn
 	c.conn = tcpConn
 	c.controlReader = bufio.NewReader(tcpConn)
 	c.controlWriter = bufio.NewWriter(tcpConn)
 	c.driver = driver
+	c.server = server
 	c.sessionId = newSessionId()
 	c.logger = newFtpLogger(c.sessionId)
-	c.serverName = serverName
-	c.minDataPort = minPort
-	c.maxDataPort = maxPort
-	c.pasvAdvertisedIp = pasvAdvertisedIp
+	c.mlstFacts = mlsxFacts
+	c.transferType = "ASCII"
+	c.ctx, c.cancel = context.WithCancel(context.WithValue(server.ctx, sessionContextKey{}, newSession(c)))
+	if _, ok := tcpConn.(*tls.Conn); ok {
+		// implicit FTPS, everything is protected from the start
+		c.tlsEnabled = true
+		c.pbszSent = true
+		c.protectData = true
+	}
 	return c
 }
 
@@ -69,6 +97,10 @@ func newSessionId() string {
 // message when the connection closes. This loop will be running inside a
 // goroutine, so use this channel to be notified when the connection can be
 // cleaned up.
+//
+// Data transfers run in a separate goroutine, so this loop can continue to
+// read commands while a transfer is in progress. Serve won't return until
+// any in-flight transfer has finished.
 func (ftpConn *ftpConn) Serve() {
 	defer func() {
 		if r := recover(); r != nil {
@@ -76,28 +108,125 @@ func (ftpConn *ftpConn) Serve() {
 		}
 
 		ftpConn.Close()
+		ftpConn.waitForTransfer()
 	}()
 
 	ftpConn.logger.Printf("Connection Established (local: %s, remote: %s)", ftpConn.localIP(), ftpConn.remoteIP())
+	if tlsConn, ok := ftpConn.conn.(*tls.Conn); ok {
+		// a client that never starts the handshake mustn't hold the
+		// connection open forever, even if there's no idle timeout
+		ftpConn.netConn.SetDeadline(time.Now().Add(ftpConn.server.handshakeTimeout))
+		err := tlsConn.Handshake()
+		ftpConn.netConn.SetDeadline(time.Time{})
+		if err != nil {
+			ftpConn.logger.Printf("TLS handshake failed: %s", err)
+			return
+		}
+	}
 	// send welcome
-	ftpConn.writeMessage(220, ftpConn.serverName)
+	ftpConn.writeMessage(220, ftpConn.server.serverName)
 	// read commands
 	for {
+		ftpConn.resetIdleTimeout()
 		line, err := ftpConn.controlReader.ReadString('\n')
 		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				ftpConn.writeMessage(421, "Timeout")
+			}
+			break
+		}
+		if !ftpConn.startCommand() {
 			break
 		}
 		ftpConn.receiveLine(line)
+		ftpConn.finishCommand()
 	}
 	ftpConn.logger.Print("Connection Terminated")
 }
 
+// how long clients using implicit TLS have to complete the TLS handshake
+const tlsHandshakeTimeout = 30 * time.Second
+
 // Close will manually close this connection, even if the client isn't ready.
+// Any transfer that is in progress will be aborted, and the context passed to
+// the driver is cancelled.
 func (ftpConn *ftpConn) Close() {
+	ftpConn.cancel()
 	ftpConn.conn.Close()
 	if ftpConn.dataConn != nil {
 		ftpConn.dataConn.Close()
 	}
+	if transfer := ftpConn.currentTransfer(); transfer != nil {
+		transfer.Abort()
+	}
+}
+
+// resetIdleTimeout restarts the timer that disconnects idle clients. While a
+// transfer is in progress the timer is paused.
+func (ftpConn *ftpConn) resetIdleTimeout() {
+	if ftpConn.server.idleTimeout == 0 {
+		return
+	}
+	if ftpConn.currentTransfer() != nil {
+		ftpConn.netConn.SetReadDeadline(time.Time{})
+	} else {
+		ftpConn.netConn.SetReadDeadline(time.Now().Add(ftpConn.server.idleTimeout))
+	}
+}
+
+// startCommand marks the connection as busy while a command is processed, so
+// a graceful shutdown won't close it. Returns false if the connection is
+// closing, in which case the command should be ignored.
+func (ftpConn *ftpConn) startCommand() bool {
+	ftpConn.stateMutex.Lock()
+	if !ftpConn.closing && ftpConn.server.shuttingDown() && ftpConn.transfer == nil {
+		ftpConn.closing = true
+		ftpConn.stateMutex.Unlock()
+		ftpConn.writeMessage(421, "Server shutting down, closing control connection")
+		return false
+	}
+	ftpConn.busy = !ftpConn.closing
+	ftpConn.stateMutex.Unlock()
+	return ftpConn.busy
+}
+
+// finishCommand marks the connection as idle once a command has been
+// processed. A transfer started by the command may still be running.
+func (ftpConn *ftpConn) finishCommand() {
+	ftpConn.stateMutex.Lock()
+	ftpConn.busy = false
+	ftpConn.stateMutex.Unlock()
+}
+
+// closeIfIdle is used during a graceful shutdown. If the connection isn't
+// processing a command or transferring data, the client is told the server is
+// shutting down and the connection is closed. Returns true if the connection
+// was closed.
+func (ftpConn *ftpConn) closeIfIdle() bool {
+	ftpConn.stateMutex.Lock()
+	idle := !ftpConn.busy && ftpConn.transfer == nil
+	alreadyClosing := ftpConn.closing
+	if idle {
+		ftpConn.closing = true
+	}
+	ftpConn.stateMutex.Unlock()
+	if idle && !alreadyClosing {
+		ftpConn.writeMessage(421, "Server shutting down, closing control connection")
+		ftpConn.forceClose()
+	}
+	return idle
+}
+
+// forceClose closes the underlying network connection, aborts any transfer in
+// progress and cancels the context passed to the driver. Unlike Close it is
+// safe to call from other goroutines, the goroutine running Serve() will
+// notice and clean up.
+func (ftpConn *ftpConn) forceClose() {
+	ftpConn.cancel()
+	ftpConn.netConn.Close()
+	if transfer := ftpConn.currentTransfer(); transfer != nil {
+		transfer.Abort()
+	}
 }
 
 // receiveLine accepts a single line FTP command and co-ordinates an
@@ -105,11 +234,26 @@ func (ftpConn *ftpConn) Close() {
 func (ftpConn *ftpConn) receiveLine(line string) {
 	command, param := ftpConn.parseLine(line)
 	ftpConn.logger.PrintCommand(command, param)
-	cmdObj := commands[command]
+	if command != "REST" && command != "RETR" && command != "STOR" {
+		// RFC 959 requires REST to be followed immediately by the transfer
+		// it applies to, so any other command cancels it
+		ftpConn.restOffset = 0
+	}
+	cmdObj := ftpConn.server.commands[command]
 	if cmdObj == nil {
 		ftpConn.writeMessage(500, "Command not found")
 		return
 	}
+	if !concurrentCommands[command] {
+		ftpConn.waitForTransfer()
+		ftpConn.command = strings.TrimSpace(command + " " + param)
+	}
+	ftpConn.executeCommand(cmdObj, param)
+}
+
+// executeCommand runs cmdObj with param, if the client has met the
+// requirements of the command.
+func (ftpConn *ftpConn) executeCommand(cmdObj ftpCommand, param string) {
 	if cmdObj.RequireParam() && param == "" {
 		ftpConn.writeMessage(553, "action aborted, required param missing")
 	} else if cmdObj.RequireAuth() && ftpConn.user == "" {
@@ -120,6 +264,11 @@ func (ftpConn *ftpConn) receiveLine(line string) {
 }
 
 func (ftpConn *ftpConn) parseLine(line string) (string, string) {
+	// clients may send the telnet "interrupt process" and "synch" sequences
+	// before ABOR, as described in RFC 959. They have no meaning to us.
+	for len(line) > 0 && (line[0] == 0xFF || line[0] == 0xF4 || line[0] == 0xF2) {
+		line = line[1:]
+	}
 	params := strings.SplitN(strings.Trim(line, "\r\n"), " ", 2)
 	if len(params) == 1 {
 		return params[0], ""
@@ -127,19 +276,65 @@ func (ftpConn *ftpConn) parseLine(line string) (string, string) {
 	return params[0], strings.TrimSpace(params[1])
 }
 
+// upgradeToTLS performs a TLS handshake over the control connection and, if
+// successful, replaces the plaintext reader and writer. Used by AUTH TLS.
+func (ftpConn *ftpConn) upgradeToTLS() error {
+	tlsConn := tls.Server(ftpConn.conn, ftpConn.server.tlsConfig)
+	err := tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+	ftpConn.conn = tlsConn
+	ftpConn.controlReader = bufio.NewReader(tlsConn)
+	ftpConn.controlWriter = bufio.NewWriter(tlsConn)
+	ftpConn.tlsEnabled = true
+	return nil
+}
+
+// dataTLSConfig returns the TLS config that new data sockets should use, or
+// nil if the client hasn't requested protected data connections with PROT P.
+func (ftpConn *ftpConn) dataTLSConfig() *tls.Config {
+	if ftpConn.protectData {
+		return ftpConn.server.tlsConfig
+	}
+	return nil
+}
+
+// checkDataProtection enforces the server policy on protected data
+// connections. If the policy isn't met an error is sent to the client and
+// false is returned, so the calling command can abort.
+func (ftpConn *ftpConn) checkDataProtection() bool {
+	if ftpConn.server.requireTLSForData && !ftpConn.protectData {
+		ftpConn.writeMessage(521, "Data connections must be protected, use PROT P")
+		return false
+	}
+	return true
+}
+
 // writeMessage will send a standard FTP response back to the client.
 func (ftpConn *ftpConn) writeMessage(code int, message string) (wrote int, err error) {
 	ftpConn.logger.PrintResponse(code, message)
 	line := fmt.Sprintf("%d %s\r\n", code, message)
+	ftpConn.writeMutex.Lock()
+	defer ftpConn.writeMutex.Unlock()
 	wrote, err = ftpConn.controlWriter.WriteString(line)
 	ftpConn.controlWriter.Flush()
 	return
 }
 
+// writeError will send a reply that describes why a driver action failed. The
+// errors defined by graval have their own replies, for anything else the
+// provided code and message are used.
+func (ftpConn *ftpConn) writeError(err error, code int, message string) (wrote int, err2 error) {
+	return ftpConn.writeMessage(replyForError(err, code, message))
+}
+
 // writeLines will send a multiline FTP response back to the client.
 func (ftpConn *ftpConn) writeLines(code int, lines ...string) (wrote int, err error) {
 	message := strings.Join(lines, "\r\n") + "\r\n"
 	ftpConn.logger.PrintResponse(code, message)
+	ftpConn.writeMutex.Lock()
+	defer ftpConn.writeMutex.Unlock()
 	wrote, err = ftpConn.controlWriter.WriteString(message)
 	ftpConn.controlWriter.Flush()
 	return
@@ -174,42 +369,261 @@ func (ftpConn *ftpConn) buildPath(filename string) (fullPath string) {
 	return
 }
 
+// statPath returns the details of a single file or directory, or nil if it
+// doesn't exist. Drivers can only list directories, so we find the entry in
+// the parent directory.
+func (ftpConn *ftpConn) statPath(path string) os.FileInfo {
+	if path == "/" {
+		modtime, _ := ftpConn.driver.ModifiedTime(ftpConn.ctx, path)
+		return NewDirItem("/", modtime)
+	}
+	name := filepath.Base(path)
+	files, err := ftpConn.driver.DirContents(ftpConn.ctx, filepath.Dir(path))
+	if err != nil {
+		return nil
+	}
+	for _, file := range files {
+		if file.Name() == name {
+			return file
+		}
+	}
+	return nil
+}
+
 // the server IP that is being used for this connection. May be the same for all connections,
 // or may vary if the server is listening on 0.0.0.0
 func (ftpConn *ftpConn) localIP() string {
-	lAddr := ftpConn.conn.LocalAddr().(*net.TCPAddr)
-	return lAddr.IP.String()
+	return addrIP(ftpConn.conn.LocalAddr())
 }
 
 // the client IP address
 func (ftpConn *ftpConn) remoteIP() string {
-	rAddr := ftpConn.conn.RemoteAddr().(*net.TCPAddr)
-	return rAddr.IP.String()
+	return addrIP(ftpConn.conn.RemoteAddr())
 }
 
-// sendOutofbandData will copy data from reader to the client via the currently
-// open data socket. Assumes the socket is open and ready to be used.
-func (ftpConn *ftpConn) sendOutofbandReader(reader io.Reader) {
-	defer ftpConn.dataConn.Close()
+// addrIP returns the IP part of addr. Listeners passed to FTPServer.Serve()
+// may not be TCP listeners, so if addr has no IP it's returned as is.
+func addrIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
 
-	_, err := io.Copy(ftpConn.dataConn, reader)
+// getFile asks the driver for a reader that will return the contents of path,
+// starting offset bytes into the file. If the driver can't resume downloads
+// directly the reader starts at the beginning of the file, and the number of
+// leading bytes the caller must skip is returned. ctx should be the context
+// of the transfer, so the driver can stop reading if it's aborted.
+func (ftpConn *ftpConn) getFile(ctx context.Context, path string, offset int64) (io.ReadCloser, int64, error) {
+	if offset == 0 {
+		reader, err := ftpConn.driver.GetFile(ctx, path)
+		return reader, 0, err
+	}
+	if getFileAt := resumeReader(ftpConn.driver); getFileAt != nil {
+		reader, err := getFileAt(ctx, path, offset)
+		return reader, 0, err
+	}
+	reader, err := ftpConn.driver.GetFile(ctx, path)
+	return reader, offset, err
+}
 
-	if err != nil {
-		ftpConn.logger.Printf("sendOutofbandReader copy error %s", err)
-		ftpConn.writeMessage(550, "Action not taken")
-		return
+// skipBytes discards the first n bytes from reader, a chunk at a time so it
+// stops promptly if ctx is cancelled. It's an error for reader to end early.
+func skipBytes(ctx context.Context, reader io.Reader, n int64) error {
+	for n > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk := int64(32 * 1024)
+		if n < chunk {
+			chunk = n
+		}
+		skipped, err := io.CopyN(ioutil.Discard, reader, chunk)
+		n -= skipped
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putFile asks the driver to persist the data from reader to path, starting
+// offset bytes into the file.
+func (ftpConn *ftpConn) putFile(ctx context.Context, path string, reader io.Reader, offset int64) error {
+	if offset == 0 {
+		return ftpConn.driver.PutFile(ctx, path, reader)
+	}
+	putFileAt := resumeWriter(ftpConn.driver)
+	if putFileAt == nil {
+		return errActionFailed
+	}
+	return putFileAt(ctx, path, reader, offset)
+}
+
+// newTransfer prepares a transfer for the current command. Its context can be
+// passed to the driver before the transfer starts, so that aborting the
+// transfer cancels the driver's work too.
+func (ftpConn *ftpConn) newTransfer() *ftpTransfer {
+	transfer := newTransfer(ftpConn.ctx, ftpConn.command)
+	transfer.stallTimeout = ftpConn.server.stallTimeout
+	return transfer
+}
+
+// startTransfer runs fn in a new goroutine with exclusive use of the currently
+// open data socket, which will be closed when fn returns. fn is responsible
+// for sending the final reply to the client. Returns false if there's no data
+// socket open.
+func (ftpConn *ftpConn) startTransfer(transfer *ftpTransfer, fn func(*ftpTransfer)) bool {
+	if ftpConn.dataConn == nil {
+		transfer.cancel()
+		ftpConn.writeMessage(425, "Can't open data connection, use PASV or PORT first")
+		return false
+	}
+	transfer.socket = ftpConn.dataConn
+	ftpConn.dataConn = nil
+
+	ftpConn.stateMutex.Lock()
+	ftpConn.transfer = transfer
+	ftpConn.stateMutex.Unlock()
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				ftpConn.logger.Printf("Recovered in ftpConn transfer: %s", r)
+			}
+			transfer.socket.Close()
+			transfer.cancel()
+			atomic.AddInt64(&ftpConn.bytesTotal, transfer.Bytes())
+
+			ftpConn.stateMutex.Lock()
+			ftpConn.transfer = nil
+			ftpConn.stateMutex.Unlock()
+			ftpConn.resetIdleTimeout()
+			close(transfer.done)
+		}()
+		fn(transfer)
+	}()
+	return true
+}
+
+// statusLines describes the state of the session for the STAT command.
+func (ftpConn *ftpConn) statusLines() []string {
+	socket := ftpConn.dataConn
+	transfer := ftpConn.currentTransfer()
+	if transfer != nil {
+		socket = transfer.socket
+	}
+	dataMode := "none"
+	switch socket.(type) {
+	case *ftpPassiveSocket:
+		dataMode = "passive"
+	case *ftpActiveSocket:
+		dataMode = "active"
+	}
+	security := "plain text"
+	if ftpConn.tlsEnabled {
+		security = "TLS"
+	}
+	lines := []string{
+		"Connected to " + ftpConn.remoteIP(),
+		"Logged in as " + ftpConn.user,
+		"Working directory is " + ftpConn.namePrefix,
+		"TYPE: " + ftpConn.transferType,
+		"Control connection: " + security,
+		"Data connection: " + dataMode,
+		fmt.Sprintf("Bytes transferred: %d", atomic.LoadInt64(&ftpConn.bytesTotal)),
+	}
+	if transfer != nil {
+		lines = append(lines, fmt.Sprintf("Transfer in progress: %s, %d bytes so far", transfer.description, transfer.Bytes()))
+	}
+	return lines
+}
+
+// currentTransfer returns the transfer that is in progress, or nil.
+func (ftpConn *ftpConn) currentTransfer() *ftpTransfer {
+	ftpConn.stateMutex.Lock()
+	defer ftpConn.stateMutex.Unlock()
+	return ftpConn.transfer
+}
+
+// waitForTransfer blocks until any transfer in progress has finished.
+func (ftpConn *ftpConn) waitForTransfer() {
+	if transfer := ftpConn.currentTransfer(); transfer != nil {
+		transfer.Wait()
+	}
+}
+
+// writeTransferError reports a failed transfer to the client. If the transfer
+// failed because the client aborted it, RFC 959 requires a 426 reply.
+// Otherwise see writeError().
+func (ftpConn *ftpConn) writeTransferError(transfer *ftpTransfer, err error, code int, message string) {
+	if transfer.Aborted() {
+		ftpConn.writeMessage(426, "Connection closed; transfer aborted.")
+	} else if err == errDataSocketUnavailable {
+		ftpConn.writeMessage(425, "Can't open data connection")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		ftpConn.writeMessage(426, "Data connection timed out; transfer aborted.")
+	} else {
+		ftpConn.writeError(err, code, message)
 	}
+}
+
+// sendOutofbandReader will copy data from reader to the client via the
+// currently open data socket, then close reader. The first skip bytes from
+// reader are discarded. The copy runs in a new goroutine as transfer, see
+// startTransfer().
+func (ftpConn *ftpConn) sendOutofbandReader(transfer *ftpTransfer, reader io.ReadCloser, skip int64) {
+	started := ftpConn.startTransfer(transfer, func(transfer *ftpTransfer) {
+		defer reader.Close()
 
-	ftpConn.writeMessage(226, "Transfer complete.")
+		err := skipBytes(transfer.ctx, reader, skip)
+		if err == nil {
+			_, err = io.Copy(transfer, reader)
+		}
+
+		if err != nil {
+			ftpConn.logger.Printf("sendOutofbandReader copy error %s", err)
+			ftpConn.writeTransferError(transfer, err, 550, "Action not taken")
+			return
+		}
 
-	// Chrome dies on localhost if we close connection to soon
-	time.Sleep(10 * time.Millisecond)
+		ftpConn.writeMessage(226, "Transfer complete.")
+
+		// Chrome dies on localhost if we close connection to soon
+		time.Sleep(10 * time.Millisecond)
+	})
+	if !started {
+		reader.Close()
+	}
 }
 
 // sendOutofbandData will send a string to the client via the currently open
-// data socket. Assumes the socket is open and ready to be used.
+// data socket.
 func (ftpConn *ftpConn) sendOutofbandData(data string) {
-	ftpConn.sendOutofbandReader(bytes.NewReader([]byte(data)))
+	ftpConn.sendOutofbandReader(ftpConn.newTransfer(), ioutil.NopCloser(bytes.NewReader([]byte(data))), 0)
+}
+
+// receiveOutofbandReader passes a reader for the data the client is sending
+// via the currently open data socket to store, which should return an error
+// if the data couldn't be persisted. Like sendOutofbandReader, this runs in a
+// new goroutine. The context passed to store is cancelled if the transfer is
+// aborted.
+func (ftpConn *ftpConn) receiveOutofbandReader(store func(context.Context, io.Reader) error) {
+	ftpConn.startTransfer(ftpConn.newTransfer(), func(transfer *ftpTransfer) {
+		if err := store(transfer.ctx, transfer); err == nil {
+			ftpConn.writeMessage(226, "Transfer complete.")
+		} else {
+			ftpConn.logger.Printf("receiveOutofbandReader error %s", err)
+			ftpConn.writeTransferError(transfer, err, 450, "error during transfer")
+		}
+	})
 }
 
 func (ftpConn *ftpConn) newPassiveSocket() (socket *ftpPassiveSocket, err error) {
@@ -218,7 +632,7 @@ func (ftpConn *ftpConn) newPassiveSocket() (socket *ftpPassiveSocket, err error)
 		ftpConn.dataConn = nil
 	}
 
-	socket, err = newPassiveSocket(ftpConn.localIP(), ftpConn.minDataPort, ftpConn.maxDataPort, ftpConn.logger)
+	socket, err = newPassiveSocket(ftpConn.localIP(), ftpConn.server.pasvPorts, ftpConn.dataTLSConfig(), ftpConn.server.dataAcceptTimeout, ftpConn.passivePeerIP(), ftpConn.logger)
 
 	if err == nil {
 		ftpConn.dataConn = socket
@@ -227,13 +641,68 @@ func (ftpConn *ftpConn) newPassiveSocket() (socket *ftpPassiveSocket, err error)
 	return
 }
 
+// writePassiveError reports why a passive data socket couldn't be opened.
+func (ftpConn *ftpConn) writePassiveError(err error) {
+	if err == errPortsExhausted {
+		ftpConn.writeMessage(425, "No passive ports available, try again later")
+	} else {
+		ftpConn.writeMessage(425, "Data connection failed")
+	}
+}
+
+// networkProtocol returns the RFC 2428 network protocol number of the control
+// connection, 1 for IPv4 or 2 for IPv6.
+func (ftpConn *ftpConn) networkProtocol() int {
+	if net.ParseIP(ftpConn.localIP()).To4() != nil {
+		return 1
+	}
+	return 2
+}
+
+// checkNotEpsvAll enforces RFC 2428, once a client has sent "EPSV ALL" every
+// other command that sets up a data connection must be refused. If the
+// client has sent it an error is sent and false is returned.
+func (ftpConn *ftpConn) checkNotEpsvAll() bool {
+	if ftpConn.epsvAll {
+		ftpConn.writeMessage(503, "Bad sequence of commands, only EPSV is allowed after EPSV ALL")
+		return false
+	}
+	return true
+}
+
+// passivePeerIP returns the address that may connect to passive data sockets,
+// or nil if any address may.
+func (ftpConn *ftpConn) passivePeerIP() net.IP {
+	if ftpConn.server.pasvAllowForeignPeer {
+		return nil
+	}
+	return net.ParseIP(ftpConn.remoteIP())
+}
+
+// checkActiveTarget protects against the FTP bounce attack, where a client
+// uses PORT or EPRT to make the server connect to a third party. Unless FXP
+// is allowed, active data connections may only be made to the client's own
+// address. Privileged ports are always refused. If the target isn't allowed
+// an error is sent to the client and false is returned.
+func (ftpConn *ftpConn) checkActiveTarget(ip net.IP, port int) bool {
+	if port < 1024 || port > 65535 {
+		ftpConn.writeMessage(504, "Data connections to privileged ports are not allowed")
+		return false
+	}
+	if !ftpConn.server.allowFXP && !ip.Equal(net.ParseIP(ftpConn.remoteIP())) {
+		ftpConn.writeMessage(504, "Data connections to other hosts are not allowed")
+		return false
+	}
+	return true
+}
+
 func (ftpConn *ftpConn) newActiveSocket(host string, port int) (socket *ftpActiveSocket, err error) {
 	if ftpConn.dataConn != nil {
 		ftpConn.dataConn.Close()
 		ftpConn.dataConn = nil
 	}
 
-	socket, err = newActiveSocket(host, port, ftpConn.logger)
+	socket, err = newActiveSocket(host, port, ftpConn.dataTLSConfig(), ftpConn.logger)
 
 	if err == nil {
 		ftpConn.dataConn = socket
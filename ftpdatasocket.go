@@ -1,10 +1,10 @@
 package graval
 
 import (
+	"crypto/tls"
 	"errors"
-	"math/rand"
 	"net"
-	"strconv"
+	"sync"
 	"time"
 )
 
@@ -23,16 +23,26 @@ type ftpDataSocket interface {
 
 	// the standard io.Closer interface
 	Close() error
+
+	// the standard net.Conn SetDeadline function
+	SetDeadline(t time.Time) error
 }
 
+// errDataSocketUnavailable is returned when the client didn't connect to a
+// passive data socket in time.
+var errDataSocketUnavailable = errors.New("data socket unavailable")
+
 type ftpActiveSocket struct {
-	conn   *net.TCPConn
+	conn   net.Conn
 	host   string
 	port   int
 	logger *ftpLogger
 }
 
-func newActiveSocket(host string, port int, logger *ftpLogger) (*ftpActiveSocket, error) {
+// newActiveSocket connects to a client listening on host and port. If
+// tlsConfig is non-nil the data connection will be protected with TLS, with
+// the server acting as the TLS server as required by RFC 4217.
+func newActiveSocket(host string, port int, tlsConfig *tls.Config, logger *ftpLogger) (*ftpActiveSocket, error) {
 	connectTo := buildTcpString(host, port)
 	logger.Print("Opening active data connection to " + connectTo)
 	raddr, err := net.ResolveTCPAddr("tcp", connectTo)
@@ -46,7 +56,11 @@ func newActiveSocket(host string, port int, logger *ftpLogger) (*ftpActiveSocket
 		return nil, err
 	}
 	socket := new(ftpActiveSocket)
-	socket.conn = tcpConn
+	if tlsConfig != nil {
+		socket.conn = tls.Server(tcpConn, tlsConfig)
+	} else {
+		socket.conn = tcpConn
+	}
 	socket.host = host
 	socket.port = port
 	socket.logger = logger
@@ -73,24 +87,48 @@ func (socket *ftpActiveSocket) Close() error {
 	return socket.conn.Close()
 }
 
-type ftpPassiveSocket struct {
-	conn     *net.TCPConn
-	port     int
-	listenIP string
-	logger   *ftpLogger
+func (socket *ftpActiveSocket) SetDeadline(t time.Time) error {
+	return socket.conn.SetDeadline(t)
 }
 
-func newPassiveSocket(listenIP string, minPort int, maxPort int, logger *ftpLogger) (*ftpPassiveSocket, error) {
+type ftpPassiveSocket struct {
+	conn          net.Conn
+	port          int
+	listenIP      string
+	tlsConfig     *tls.Config
+	acceptTimeout time.Duration
+	peerIP        net.IP
+	listener      *net.TCPListener
+	release       func()
+	mutex         sync.Mutex
+	closed        bool
+	accepted      chan struct{}
+	logger        *ftpLogger
+}
+
+// newPassiveSocket opens a listening socket for the client to connect to,
+// using a port leased from pool. If tlsConfig is non-nil the data connection
+// will be protected with TLS. If the client doesn't connect within
+// acceptTimeout the socket is closed, unless acceptTimeout is 0. If peerIP is
+// non-nil, connections from other addresses are refused so they can't steal
+// the data connection.
+func newPassiveSocket(listenIP string, pool *ftpPortPool, tlsConfig *tls.Config, acceptTimeout time.Duration, peerIP net.IP, logger *ftpLogger) (*ftpPassiveSocket, error) {
+	listener, release, err := pool.Listen(listenIP)
+	if err != nil {
+		logger.Print(err)
+		return nil, err
+	}
 	socket := new(ftpPassiveSocket)
 	socket.logger = logger
 	socket.listenIP = listenIP
-	go socket.ListenAndServe(minPort, maxPort)
-	for {
-		if socket.Port() > 0 {
-			break
-		}
-		time.Sleep(100 * time.Millisecond)
-	}
+	socket.tlsConfig = tlsConfig
+	socket.acceptTimeout = acceptTimeout
+	socket.peerIP = peerIP
+	socket.listener = listener
+	socket.release = release
+	socket.port = listener.Addr().(*net.TCPAddr).Port
+	socket.accepted = make(chan struct{})
+	go socket.ListenAndServe()
 	return socket, nil
 }
 
@@ -104,75 +142,81 @@ func (socket *ftpPassiveSocket) Port() int {
 
 func (socket *ftpPassiveSocket) Read(p []byte) (n int, err error) {
 	if socket.waitForOpenSocket() == false {
-		return 0, errors.New("data socket unavailable")
+		return 0, errDataSocketUnavailable
 	}
 	return socket.conn.Read(p)
 }
 
 func (socket *ftpPassiveSocket) Write(p []byte) (n int, err error) {
 	if socket.waitForOpenSocket() == false {
-		return 0, errors.New("data socket unavailable")
+		return 0, errDataSocketUnavailable
 	}
 	return socket.conn.Write(p)
 }
 
+func (socket *ftpPassiveSocket) SetDeadline(t time.Time) error {
+	if socket.waitForOpenSocket() == false {
+		return errDataSocketUnavailable
+	}
+	return socket.conn.SetDeadline(t)
+}
+
+// Close stops waiting for the client to connect, or closes the data
+// connection if they already have.
 func (socket *ftpPassiveSocket) Close() error {
 	socket.logger.Print("closing passive data socket")
-	if socket.conn != nil {
-		return socket.conn.Close()
+	socket.mutex.Lock()
+	socket.closed = true
+	conn := socket.conn
+	socket.mutex.Unlock()
+	socket.listener.Close()
+	if conn != nil {
+		return conn.Close()
 	}
 	return nil
 }
 
-func (socket *ftpPassiveSocket) ListenAndServe(minPort int, maxPort int) {
-	listener, err := socket.netListenerInRange(minPort, maxPort)
-	if err != nil {
-		socket.logger.Print(err)
-		return
-	}
-	defer listener.Close()
-	add := listener.Addr().(*net.TCPAddr)
-	socket.port = add.Port
-	tcpConn, err := listener.AcceptTCP()
-	if err != nil {
-		socket.logger.Print(err)
-		return
+// ListenAndServe waits for the client to connect, then closes the listener
+// and returns the port to the pool.
+func (socket *ftpPassiveSocket) ListenAndServe() {
+	defer close(socket.accepted)
+	defer socket.release()
+	defer socket.listener.Close()
+	if socket.acceptTimeout > 0 {
+		socket.listener.SetDeadline(time.Now().Add(socket.acceptTimeout))
 	}
-	socket.conn = tcpConn
-}
-
-func (socket *ftpPassiveSocket) waitForOpenSocket() bool {
-	retries := 0
+	var tcpConn *net.TCPConn
 	for {
-		if socket.conn != nil {
-			break
+		var err error
+		tcpConn, err = socket.listener.AcceptTCP()
+		if err != nil {
+			socket.logger.Print(err)
+			return
 		}
-		if retries > 3 {
-			return false
+		remoteIP := tcpConn.RemoteAddr().(*net.TCPAddr).IP
+		if socket.peerIP == nil || socket.peerIP.Equal(remoteIP) {
+			break
 		}
-		socket.logger.Print("sleeping, socket isn't open")
-		sleepMs := time.Duration(500 * (retries + 1))
-		time.Sleep(sleepMs * time.Millisecond)
-		retries += 1
+		socket.logger.Printf("refusing passive data connection from %s, expected %s", remoteIP, socket.peerIP)
+		tcpConn.Close()
 	}
-	return true
-}
 
-func (socket *ftpPassiveSocket) netListenerInRange(min, max int) (*net.TCPListener, error) {
-	for retries := 1; retries < 100; retries++ {
-		port := randomPort(min, max)
-		l, err := net.Listen("tcp", net.JoinHostPort(socket.Host(), strconv.Itoa(port)))
-		if err == nil {
-			return l.(*net.TCPListener), nil
-		}
+	var conn net.Conn = tcpConn
+	if socket.tlsConfig != nil {
+		conn = tls.Server(tcpConn, socket.tlsConfig)
+	}
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	if socket.closed {
+		conn.Close()
+		return
 	}
-	return nil, errors.New("Unable to find available port to listen on")
+	socket.conn = conn
 }
 
-func randomPort(min, max int) int {
-	if min == 0 && max == 0 {
-		return 0
-	} else {
-		return min + rand.Intn(max-min-1)
-	}
+// waitForOpenSocket blocks until the client has connected to the socket.
+// Returns false if they didn't connect in time, or the socket was closed.
+func (socket *ftpPassiveSocket) waitForOpenSocket() bool {
+	<-socket.accepted
+	return socket.conn != nil
 }
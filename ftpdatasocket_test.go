@@ -0,0 +1,43 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPassiveSocketPeer(t *testing.T) {
+	Convey("Passive data sockets only accept connections from the expected peer", t, func() {
+		socket, err := newPassiveSocket("127.0.0.1", newPortPool(0, 0), nil, 500*time.Millisecond, net.ParseIP("127.0.0.2"), newFtpLogger("test"))
+		So(err, ShouldBeNil)
+		defer socket.Close()
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(socket.Port()))
+
+		thief, err := net.Dial("tcp", addr)
+		So(err, ShouldBeNil)
+		defer thief.Close()
+		thief.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = thief.Read(make([]byte, 1))
+		So(err, ShouldNotBeNil)
+
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}
+		client, err := dialer.Dial("tcp", addr)
+		So(err, ShouldBeNil)
+		defer client.Close()
+		client.Write([]byte("hi"))
+		buf := make([]byte, 2)
+		_, err = socket.Read(buf)
+		So(err, ShouldBeNil)
+		So(string(buf), ShouldEqual, "hi")
+	})
+
+	Convey("Passive data sockets give up if the client doesn't connect in time", t, func() {
+		socket, err := newPassiveSocket("127.0.0.1", newPortPool(0, 0), nil, 100*time.Millisecond, nil, newFtpLogger("test"))
+		So(err, ShouldBeNil)
+		defer socket.Close()
+		_, err = socket.Read(make([]byte, 1))
+		So(err, ShouldEqual, errDataSocketUnavailable)
+	})
+}
@@ -1,6 +1,7 @@
 package graval
 
 import (
+	"context"
 	"io"
 	"os"
 	"time"
@@ -65,3 +66,180 @@ type FTPDriver interface {
 	// returns - true if the data was successfully persisted
 	PutFile(string, io.Reader) bool
 }
+
+// FTPDriverFactoryV2 is the equivalent of FTPDriverFactory for drivers that
+// implement FTPDriverV2.
+type FTPDriverFactoryV2 interface {
+	NewDriver() (FTPDriverV2, error)
+}
+
+// FTPDriverV2 is an alternative to FTPDriver where every method can return an
+// error. Return one of the errors defined by graval, like ErrNotFound or
+// ErrQuotaExceeded, or an *FTPError, and graval will send the client the
+// most appropriate reply code. Any other errors will be reported to the
+// client with a generic reply.
+type FTPDriverV2 interface {
+	// params  - username, password
+	// returns - nil if the provided details are valid
+	Authenticate(string, string) error
+
+	// params  - a file path
+	// returns - an int with the number of bytes in the file
+	Bytes(string) (int64, error)
+
+	// params  - a file path
+	// returns - a time indicating when the requested path was last modified
+	ModifiedTime(string) (time.Time, error)
+
+	// params  - path
+	// returns - nil if the current user is permitted to change to the
+	//           requested path
+	ChangeDir(string) error
+
+	// params  - path
+	// returns - a collection of items describing the contents of the requested
+	//           path
+	DirContents(string) ([]os.FileInfo, error)
+
+	// params  - path
+	// returns - nil if the directory was deleted
+	DeleteDir(string) error
+
+	// params  - path
+	// returns - nil if the file was deleted
+	DeleteFile(string) error
+
+	// params  - from_path, to_path
+	// returns - nil if the file was renamed
+	Rename(string, string) error
+
+	// params  - path
+	// returns - nil if the new directory was created
+	MakeDir(string) error
+
+	// params  - path
+	// returns - a Reader that will return file data to send to the client
+	GetFile(string) (io.ReadCloser, error)
+
+	// params  - desination path, an io.Reader containing the file data
+	// returns - nil if the data was successfully persisted
+	PutFile(string, io.Reader) error
+}
+
+// FTPContextDriverFactory is the equivalent of FTPDriverFactory for drivers
+// that implement FTPContextDriver.
+type FTPContextDriverFactory interface {
+	NewDriver() (FTPContextDriver, error)
+}
+
+// FTPContextDriver is the equivalent of FTPDriverV2 for drivers that need to
+// cancel slow operations. Every method receives a context that is cancelled
+// when the client disconnects or the server shuts down. For downloads and
+// uploads (GetFile, GetFileAt, PutFile, PutFileAt and AppendFile), the context
+// is also cancelled if the client aborts the transfer with ABOR, including
+// while the client is reading from the io.ReadCloser returned by GetFile.
+//
+// Details of the client are available from the context with
+// SessionFromContext().
+type FTPContextDriver interface {
+	// params  - context, username, password
+	// returns - nil if the provided details are valid
+	Authenticate(context.Context, string, string) error
+
+	// params  - context, a file path
+	// returns - an int with the number of bytes in the file
+	Bytes(context.Context, string) (int64, error)
+
+	// params  - context, a file path
+	// returns - a time indicating when the requested path was last modified
+	ModifiedTime(context.Context, string) (time.Time, error)
+
+	// params  - context, path
+	// returns - nil if the current user is permitted to change to the
+	//           requested path
+	ChangeDir(context.Context, string) error
+
+	// params  - context, path
+	// returns - a collection of items describing the contents of the requested
+	//           path
+	DirContents(context.Context, string) ([]os.FileInfo, error)
+
+	// params  - context, path
+	// returns - nil if the directory was deleted
+	DeleteDir(context.Context, string) error
+
+	// params  - context, path
+	// returns - nil if the file was deleted
+	DeleteFile(context.Context, string) error
+
+	// params  - context, from_path, to_path
+	// returns - nil if the file was renamed
+	Rename(context.Context, string, string) error
+
+	// params  - context, path
+	// returns - nil if the new directory was created
+	MakeDir(context.Context, string) error
+
+	// params  - context, path
+	// returns - a Reader that will return file data to send to the client
+	GetFile(context.Context, string) (io.ReadCloser, error)
+
+	// params  - context, desination path, an io.Reader containing the file data
+	// returns - nil if the data was successfully persisted
+	PutFile(context.Context, string, io.Reader) error
+}
+
+// FTPDriverResumeReader is an optional interface that drivers (v1 or v2) can implement
+// to support resuming downloads with the REST command. Drivers that don't
+// implement it still support REST, but graval will call GetFile() and discard
+// data until the requested offset is reached.
+type FTPDriverResumeReader interface {
+	// params  - a file path, the number of bytes to skip
+	// returns - a Reader that will return file data starting at the offset
+	GetFileAt(string, int64) (io.ReadCloser, error)
+}
+
+// FTPDriverResumeWriter is an optional interface that drivers can implement
+// to support resuming uploads with the REST command. If a driver doesn't
+// implement it, a STOR following REST will be refused.
+type FTPDriverResumeWriter interface {
+	// params  - destination path, an io.Reader containing the file data, the
+	//           offset to start writing at
+	// returns - an error if the data couldn't be persisted
+	PutFileAt(string, io.Reader, int64) error
+}
+
+// FTPDriverAppender is an optional interface that drivers can implement to
+// support the APPE command. If a driver doesn't implement it, clients that
+// attempt to append to a file will receive an error.
+type FTPDriverAppender interface {
+	// params  - destination path, an io.Reader containing the data to append
+	// returns - an error if the data couldn't be persisted
+	AppendFile(string, io.Reader) error
+}
+
+// FTPContextDriverResumeReader is the equivalent of FTPDriverResumeReader for
+// drivers that implement FTPContextDriver.
+type FTPContextDriverResumeReader interface {
+	// params  - context, a file path, the number of bytes to skip
+	// returns - a Reader that will return file data starting at the offset
+	GetFileAt(context.Context, string, int64) (io.ReadCloser, error)
+}
+
+// FTPContextDriverResumeWriter is the equivalent of FTPDriverResumeWriter for
+// drivers that implement FTPContextDriver.
+type FTPContextDriverResumeWriter interface {
+	// params  - context, destination path, an io.Reader containing the file
+	//           data, the offset to start writing at
+	// returns - an error if the data couldn't be persisted
+	PutFileAt(context.Context, string, io.Reader, int64) error
+}
+
+// FTPContextDriverAppender is the equivalent of FTPDriverAppender for drivers
+// that implement FTPContextDriver.
+type FTPContextDriverAppender interface {
+	// params  - context, destination path, an io.Reader containing the data to
+	//           append
+	// returns - an error if the data couldn't be persisted
+	AppendFile(context.Context, string, io.Reader) error
+}
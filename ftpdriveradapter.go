@@ -0,0 +1,180 @@
+package graval
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// errActionFailed is returned by driverV1Adapter when an FTPDriver returns
+// false, which doesn't tell us anything about why the action failed.
+var errActionFailed = errors.New("action failed")
+
+// driverV1Adapter wraps an FTPDriver so it can be used as an FTPDriverV2. That
+// way the rest of graval only needs to deal with one type of driver.
+type driverV1Adapter struct {
+	driver FTPDriver
+}
+
+func boolToError(ok bool) error {
+	if ok {
+		return nil
+	}
+	return errActionFailed
+}
+
+func (adapter driverV1Adapter) Authenticate(user string, pass string) error {
+	return boolToError(adapter.driver.Authenticate(user, pass))
+}
+
+func (adapter driverV1Adapter) Bytes(path string) (int64, error) {
+	bytes := adapter.driver.Bytes(path)
+	if bytes < 0 {
+		return bytes, errActionFailed
+	}
+	return bytes, nil
+}
+
+func (adapter driverV1Adapter) ModifiedTime(path string) (time.Time, error) {
+	return adapter.driver.ModifiedTime(path)
+}
+
+func (adapter driverV1Adapter) ChangeDir(path string) error {
+	return boolToError(adapter.driver.ChangeDir(path))
+}
+
+func (adapter driverV1Adapter) DirContents(path string) ([]os.FileInfo, error) {
+	return adapter.driver.DirContents(path), nil
+}
+
+func (adapter driverV1Adapter) DeleteDir(path string) error {
+	return boolToError(adapter.driver.DeleteDir(path))
+}
+
+func (adapter driverV1Adapter) DeleteFile(path string) error {
+	return boolToError(adapter.driver.DeleteFile(path))
+}
+
+func (adapter driverV1Adapter) Rename(fromPath string, toPath string) error {
+	return boolToError(adapter.driver.Rename(fromPath, toPath))
+}
+
+func (adapter driverV1Adapter) MakeDir(path string) error {
+	return boolToError(adapter.driver.MakeDir(path))
+}
+
+func (adapter driverV1Adapter) GetFile(path string) (io.ReadCloser, error) {
+	return adapter.driver.GetFile(path)
+}
+
+func (adapter driverV1Adapter) PutFile(path string, data io.Reader) error {
+	return boolToError(adapter.driver.PutFile(path, data))
+}
+
+// driverV2Adapter wraps an FTPDriverV2 so it can be used as an
+// FTPContextDriver. The context is ignored.
+type driverV2Adapter struct {
+	driver FTPDriverV2
+}
+
+func (adapter driverV2Adapter) Authenticate(ctx context.Context, user string, pass string) error {
+	return adapter.driver.Authenticate(user, pass)
+}
+
+func (adapter driverV2Adapter) Bytes(ctx context.Context, path string) (int64, error) {
+	return adapter.driver.Bytes(path)
+}
+
+func (adapter driverV2Adapter) ModifiedTime(ctx context.Context, path string) (time.Time, error) {
+	return adapter.driver.ModifiedTime(path)
+}
+
+func (adapter driverV2Adapter) ChangeDir(ctx context.Context, path string) error {
+	return adapter.driver.ChangeDir(path)
+}
+
+func (adapter driverV2Adapter) DirContents(ctx context.Context, path string) ([]os.FileInfo, error) {
+	return adapter.driver.DirContents(path)
+}
+
+func (adapter driverV2Adapter) DeleteDir(ctx context.Context, path string) error {
+	return adapter.driver.DeleteDir(path)
+}
+
+func (adapter driverV2Adapter) DeleteFile(ctx context.Context, path string) error {
+	return adapter.driver.DeleteFile(path)
+}
+
+func (adapter driverV2Adapter) Rename(ctx context.Context, fromPath string, toPath string) error {
+	return adapter.driver.Rename(fromPath, toPath)
+}
+
+func (adapter driverV2Adapter) MakeDir(ctx context.Context, path string) error {
+	return adapter.driver.MakeDir(path)
+}
+
+func (adapter driverV2Adapter) GetFile(ctx context.Context, path string) (io.ReadCloser, error) {
+	return adapter.driver.GetFile(path)
+}
+
+func (adapter driverV2Adapter) PutFile(ctx context.Context, path string, data io.Reader) error {
+	return adapter.driver.PutFile(path, data)
+}
+
+// driverImplementation returns the driver that was created by the factory,
+// unwrapping it if required. Use it to check for optional interfaces like
+// FTPDriverAppender.
+func driverImplementation(driver FTPContextDriver) interface{} {
+	var impl interface{} = driver
+	if adapter, ok := impl.(driverV2Adapter); ok {
+		impl = adapter.driver
+	}
+	if adapter, ok := impl.(driverV1Adapter); ok {
+		impl = adapter.driver
+	}
+	return impl
+}
+
+// resumeReader returns the GetFileAt function of the driver, or nil if the
+// driver doesn't support resuming downloads.
+func resumeReader(driver FTPContextDriver) func(context.Context, string, int64) (io.ReadCloser, error) {
+	if resumer, ok := driver.(FTPContextDriverResumeReader); ok {
+		return resumer.GetFileAt
+	}
+	if resumer, ok := driverImplementation(driver).(FTPDriverResumeReader); ok {
+		return func(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+			return resumer.GetFileAt(path, offset)
+		}
+	}
+	return nil
+}
+
+// resumeWriter returns the PutFileAt function of the driver, or nil if the
+// driver doesn't support resuming uploads.
+func resumeWriter(driver FTPContextDriver) func(context.Context, string, io.Reader, int64) error {
+	if resumer, ok := driver.(FTPContextDriverResumeWriter); ok {
+		return resumer.PutFileAt
+	}
+	if resumer, ok := driverImplementation(driver).(FTPDriverResumeWriter); ok {
+		return func(ctx context.Context, path string, data io.Reader, offset int64) error {
+			return resumer.PutFileAt(path, data, offset)
+		}
+	}
+	return nil
+}
+
+// appender returns the AppendFile function of the driver, or nil if the
+// driver doesn't support the APPE command.
+func appender(driver FTPContextDriver) func(context.Context, string, io.Reader) error {
+	if appender, ok := driver.(FTPContextDriverAppender); ok {
+		return appender.AppendFile
+	}
+	if appender, ok := driverImplementation(driver).(FTPDriverAppender); ok {
+		return func(ctx context.Context, path string, data io.Reader) error {
+			return appender.AppendFile(path, data)
+		}
+	}
+	return nil
+}
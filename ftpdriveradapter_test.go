@@ -0,0 +1,46 @@
+package graval
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"testing"
+)
+
+type testAppendingDriver struct {
+	FTPDriverV2
+}
+
+func (driver testAppendingDriver) AppendFile(path string, data io.Reader) error {
+	return ErrQuotaExceeded
+}
+
+func TestDriverImplementation(t *testing.T) {
+	Convey("Unwraps adapted drivers", t, func() {
+		driver := testAppendingDriver{}
+		So(driverImplementation(driverV2Adapter{driver}), ShouldResemble, driver)
+	})
+
+	Convey("Finds optional interfaces on adapted drivers", t, func() {
+		driver := driverV2Adapter{testAppendingDriver{}}
+		appendFile := appender(driver)
+		So(appendFile, ShouldNotBeNil)
+		So(appendFile(context.Background(), "/foo", nil), ShouldEqual, ErrQuotaExceeded)
+		So(resumeWriter(driver), ShouldBeNil)
+	})
+}
+
+func TestSessionFromContext(t *testing.T) {
+	Convey("Returns the session stored in the context", t, func() {
+		session := &FTPSession{}
+		ctx := context.WithValue(context.Background(), sessionContextKey{}, session)
+		found, ok := SessionFromContext(ctx)
+		So(ok, ShouldBeTrue)
+		So(found, ShouldEqual, session)
+	})
+
+	Convey("Returns false for other contexts", t, func() {
+		_, ok := SessionFromContext(context.Background())
+		So(ok, ShouldBeFalse)
+	})
+}
@@ -0,0 +1,80 @@
+package graval
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors that FTPDriverV2 implementations can return to explain why an action
+// failed. graval will reply to the client with the matching FTP reply code.
+// Drivers may wrap these errors to add more detail to the logs.
+var (
+	// The requested file or directory doesn't exist. Replies with 550.
+	ErrNotFound = errors.New("file not found")
+
+	// The user isn't allowed to perform the action. Replies with 550.
+	ErrPermissionDenied = errors.New("permission denied")
+
+	// The file or directory to be created already exists. Replies with 550.
+	ErrExists = errors.New("file exists")
+
+	// The requested file name isn't allowed. Replies with 553.
+	ErrInvalidName = errors.New("file name not allowed")
+
+	// The file is temporarily unavailable, perhaps because it's in use.
+	// Replies with 450.
+	ErrBusy = errors.New("file busy")
+
+	// Something went wrong in the driver or the storage behind it, and the
+	// client may try again later. Replies with 451.
+	ErrLocalError = errors.New("local error in processing")
+
+	// There isn't enough space to store the file right now. Replies with 452.
+	ErrInsufficientStorage = errors.New("insufficient storage space")
+
+	// The user has exceeded their storage allocation. Replies with 552.
+	ErrQuotaExceeded = errors.New("exceeded storage allocation")
+)
+
+// FTPError can be returned by FTPDriverV2 implementations that need to send a
+// reply that isn't covered by the predefined errors.
+type FTPError struct {
+	Code    int
+	Message string
+}
+
+func (err *FTPError) Error() string {
+	return fmt.Sprintf("%d %s", err.Code, err.Message)
+}
+
+type errorReply struct {
+	err     error
+	code    int
+	message string
+}
+
+var errorReplies = []errorReply{
+	{ErrNotFound, 550, "File not found"},
+	{ErrPermissionDenied, 550, "Permission denied"},
+	{ErrExists, 550, "File exists"},
+	{ErrInvalidName, 553, "File name not allowed"},
+	{ErrBusy, 450, "File unavailable, try again later"},
+	{ErrLocalError, 451, "Local error in processing"},
+	{ErrInsufficientStorage, 452, "Insufficient storage space"},
+	{ErrQuotaExceeded, 552, "Exceeded storage allocation"},
+}
+
+// replyForError finds the reply code and message that best describes err. If
+// err isn't one we know about, defaultCode and defaultMessage are returned.
+func replyForError(err error, defaultCode int, defaultMessage string) (int, string) {
+	var ftpErr *FTPError
+	if errors.As(err, &ftpErr) {
+		return ftpErr.Code, ftpErr.Message
+	}
+	for _, reply := range errorReplies {
+		if errors.Is(err, reply.err) {
+			return reply.code, reply.message
+		}
+	}
+	return defaultCode, defaultMessage
+}
@@ -0,0 +1,36 @@
+package graval
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestReplyForError(t *testing.T) {
+	Convey("Maps known errors to their replies", t, func() {
+		code, message := replyForError(ErrQuotaExceeded, 550, "Action not taken")
+		So(code, ShouldEqual, 552)
+		So(message, ShouldEqual, "Exceeded storage allocation")
+	})
+
+	Convey("Maps wrapped errors to their replies", t, func() {
+		err := fmt.Errorf("mkdir /foo: %w", ErrInvalidName)
+		code, message := replyForError(err, 550, "Action not taken")
+		So(code, ShouldEqual, 553)
+		So(message, ShouldEqual, "File name not allowed")
+	})
+
+	Convey("Uses the code and message from an FTPError", t, func() {
+		err := &FTPError{Code: 532, Message: "Need account for storing files"}
+		code, message := replyForError(err, 550, "Action not taken")
+		So(code, ShouldEqual, 532)
+		So(message, ShouldEqual, "Need account for storing files")
+	})
+
+	Convey("Falls back to the default reply for unknown errors", t, func() {
+		code, message := replyForError(errors.New("boom"), 550, "Action not taken")
+		So(code, ShouldEqual, 550)
+		So(message, ShouldEqual, "Action not taken")
+	})
+}
@@ -0,0 +1,115 @@
+package graval
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// errPortsExhausted is returned when every port in the passive port range is
+// in use.
+var errPortsExhausted = errors.New("no passive ports available")
+
+// PasvPortStats describes how the ports available for passive data sockets
+// are being used. See FTPServer.PasvPortStats().
+type PasvPortStats struct {
+	// The number of ports in the PasvMinPort..PasvMaxPort range, or 0 if no
+	// range was configured and the operating system picks the ports.
+	Total int
+
+	// The number of ports currently leased to passive data sockets.
+	InUse int
+
+	// The number of times a passive data socket couldn't be opened because
+	// every port in the range was in use.
+	Exhausted uint64
+}
+
+// ftpPortPool leases ports for passive data sockets, so that concurrent
+// sessions never try to listen on the same port. Ports are handed out in
+// turn, so a port that was just released isn't reused straight away.
+type ftpPortPool struct {
+	min       int
+	max       int
+	mutex     sync.Mutex
+	leased    map[int]bool
+	next      int
+	exhausted uint64
+}
+
+// newPortPool builds a pool for the ports min..max inclusive. If either is 0
+// the operating system will pick a free port for each socket.
+func newPortPool(min int, max int) *ftpPortPool {
+	pool := new(ftpPortPool)
+	if min > 0 && max > 0 {
+		pool.min = min
+		pool.max = max
+	}
+	pool.next = pool.min
+	pool.leased = make(map[int]bool)
+	return pool
+}
+
+// Listen opens a TCP listener on ip using a port from the pool. The returned
+// release function must be called once the listener has been closed, to
+// return the port to the pool.
+func (pool *ftpPortPool) Listen(ip string) (*net.TCPListener, func(), error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if pool.min == 0 {
+		listener, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+		if err != nil {
+			return nil, nil, err
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		pool.leased[port] = true
+		return listener.(*net.TCPListener), pool.releaser(port), nil
+	}
+
+	size := pool.max - pool.min + 1
+	for i := 0; i < size; i++ {
+		port := pool.next
+		pool.next++
+		if pool.next > pool.max {
+			pool.next = pool.min
+		}
+		if pool.leased[port] {
+			continue
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+		if err != nil {
+			// probably in use by another process, try the next one
+			continue
+		}
+		pool.leased[port] = true
+		return listener.(*net.TCPListener), pool.releaser(port), nil
+	}
+	pool.exhausted++
+	return nil, nil, errPortsExhausted
+}
+
+// releaser returns a function that releases port back to the pool. It's safe
+// to call more than once.
+func (pool *ftpPortPool) releaser(port int) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			pool.mutex.Lock()
+			delete(pool.leased, port)
+			pool.mutex.Unlock()
+		})
+	}
+}
+
+// Stats reports the utilisation of the pool.
+func (pool *ftpPortPool) Stats() PasvPortStats {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	stats := PasvPortStats{InUse: len(pool.leased), Exhausted: pool.exhausted}
+	if pool.min > 0 {
+		stats.Total = pool.max - pool.min + 1
+	}
+	return stats
+}
@@ -0,0 +1,53 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestPortPool(t *testing.T) {
+	Convey("Leasing ports from a range", t, func() {
+		pool := newPortPool(60410, 60411)
+
+		first, releaseFirst, err := pool.Listen("127.0.0.1")
+		So(err, ShouldBeNil)
+		defer first.Close()
+		second, releaseSecond, err := pool.Listen("127.0.0.1")
+		So(err, ShouldBeNil)
+		defer second.Close()
+		So(first.Addr().String(), ShouldNotEqual, second.Addr().String())
+		So(pool.Stats(), ShouldResemble, PasvPortStats{Total: 2, InUse: 2})
+
+		Convey("Fails once every port is leased", func() {
+			_, _, err := pool.Listen("127.0.0.1")
+			So(err, ShouldEqual, errPortsExhausted)
+			So(pool.Stats().Exhausted, ShouldEqual, 1)
+		})
+
+		Convey("Reuses ports once they're released", func() {
+			first.Close()
+			releaseFirst()
+			releaseFirst()
+			So(pool.Stats().InUse, ShouldEqual, 1)
+			third, releaseThird, err := pool.Listen("127.0.0.1")
+			So(err, ShouldBeNil)
+			defer third.Close()
+			defer releaseThird()
+			So(third.Addr().String(), ShouldEqual, first.Addr().String())
+		})
+
+		Reset(func() {
+			releaseSecond()
+		})
+	})
+
+	Convey("Without a range the operating system picks ports", t, func() {
+		pool := newPortPool(0, 0)
+		listener, release, err := pool.Listen("127.0.0.1")
+		So(err, ShouldBeNil)
+		So(pool.Stats(), ShouldResemble, PasvPortStats{Total: 0, InUse: 1})
+		listener.Close()
+		release()
+		So(pool.Stats().InUse, ShouldEqual, 0)
+	})
+}
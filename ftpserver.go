@@ -9,9 +9,15 @@
 package graval
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,9 +27,19 @@ type FTPServerOpts struct {
 	ServerName string
 
 	// The factory that will be used to create a new FTPDriver instance for
-	// each client connection. This is a mandatory option.
+	// each client connection. This is a mandatory option, unless FactoryV2
+	// is provided instead.
 	Factory FTPDriverFactory
 
+	// The factory that will be used to create a new FTPDriverV2 instance for
+	// each client connection. If provided, Factory is ignored.
+	FactoryV2 FTPDriverFactoryV2
+
+	// The factory that will be used to create a new FTPContextDriver instance
+	// for each client connection. If provided, Factory and FactoryV2 are
+	// ignored.
+	ContextFactory FTPContextDriverFactory
+
 	// The hostname that the FTP server should listen on. Optional, defaults to
 	// "::", which means all hostnames on ipv4 and ipv6.
 	Hostname string
@@ -33,11 +49,13 @@ type FTPServerOpts struct {
 	Port int
 
 	// The lower bound of port numbers that can be used for passive-mode data sockets
-	// Defaults to 0, which allows the server to pick any free port
+	// Defaults to 0, which allows the server to pick any free port. The range is
+	// only used if PasvMaxPort is also set.
 	PasvMinPort int
 
 	// The upper bound of port numbers that can be used for passive-mode data sockets
-	// Defaults to 0, which allows the server to pick any free port
+	// Defaults to 0, which allows the server to pick any free port. Clients will
+	// be refused with a 425 reply if every port in the range is in use.
 	PasvMaxPort int
 
 	// Use this option to override the IP address that will be advertised in response to the
@@ -45,6 +63,112 @@ type FTPServerOpts struct {
 	// the FTP server is behind a NAT gateway or load balancer and the public IP used by
 	// clients is different to the IP the server is directly listening on
 	PasvAdvertisedIp string
+
+	// Use this option to advertise different addresses in response to the PASV
+	// command depending on the client's network, which is useful behind split
+	// horizon NAT. The key is a network in CIDR notation, like "10.0.0.0/8",
+	// and the value is the address to advertise to clients in that network.
+	// The most specific matching network is used. Clients that don't match
+	// any network receive PasvAdvertisedIp.
+	PasvAdvertisedIpByNetwork map[string]string
+
+	// Use this option to pick the address advertised in response to the PASV
+	// command with your own code. The function receives the IP of the client
+	// and returns the address to advertise, or an empty string to fall back
+	// to PasvAdvertisedIpByNetwork and PasvAdvertisedIp.
+	PasvAdvertisedIpFunc func(remoteIP string) string
+
+	// The advertised addresses above may be hostnames instead of IPs, which
+	// will be resolved when first used, then resolved again in the background
+	// once the address is older than this. Optional, defaults to 5 minutes.
+	PasvAdvertisedIpRefresh time.Duration
+
+	// Use this option to enable explicit FTPS (RFC 4217). When a TLS config is
+	// provided clients may use the AUTH TLS command to upgrade the control
+	// connection, and PBSZ/PROT to protect data connections. Optional, defaults
+	// to nil which means only plaintext FTP is available.
+	TLSConfig *tls.Config
+
+	// Use this option to enable implicit FTPS. Every client connection will
+	// begin with a TLS handshake before the welcome message is sent, and data
+	// connections will be protected by default. Requires TLSConfig. Implicit
+	// FTPS is usually offered on port 990.
+	ImplicitTLS bool
+
+	// Use this option to refuse the USER and PASS commands until the control
+	// connection has been protected with TLS, so credentials are never sent in
+	// the clear. Requires TLSConfig.
+	RequireTLSForAuth bool
+
+	// Use this option to refuse commands that open a data connection (LIST,
+	// RETR, STOR, etc) unless the client has requested protected data
+	// connections with PROT P. Requires TLSConfig.
+	RequireTLSForData bool
+
+	// Clients that don't send a command for this long will be sent a 421
+	// reply and disconnected. The timer is paused while a transfer is in
+	// progress. Optional, defaults to 0 which means clients can stay
+	// connected indefinitely.
+	IdleTimeout time.Duration
+
+	// How long to wait for the client to connect to a passive data socket
+	// after the PASV or EPSV command. Optional, defaults to 30 seconds.
+	DataAcceptTimeout time.Duration
+
+	// Transfers will be aborted if no data is sent or received on the data
+	// connection for this long. Optional, defaults to 0 which means stalled
+	// transfers will wait indefinitely.
+	StallTimeout time.Duration
+
+	// The maximum number of clients that can be connected at once. Extra
+	// clients will be sent a 421 reply and disconnected. Optional, defaults
+	// to 0 which means no limit.
+	MaxConnections int
+
+	// The maximum number of clients that can be connected at once from a
+	// single IP address. Optional, defaults to 0 which means no limit.
+	MaxConnectionsPerIP int
+
+	// Use this option to slow down and ban clients that repeatedly fail to
+	// log in. See NewMemoryLoginLimiter(). Optional, defaults to nil which
+	// means clients can keep trying to log in.
+	LoginLimiter LoginLimiter
+
+	// Use this option to restrict which IP addresses can connect to the
+	// server. Connections from other addresses are closed before the welcome
+	// message is sent. Optional, defaults to nil which means any address can
+	// connect.
+	AccessList *IPAccessList
+
+	// Use this option when the server is behind load balancers that send a
+	// PROXY protocol header (version 1 or 2), like HAProxy or AWS NLB. Each
+	// entry is the IP or CIDR network of a trusted load balancer. Connections
+	// from those addresses must start with a header, and the client address
+	// it contains is used for logging, access lists, connection limits and
+	// active mode checks. Connections from other addresses are served as
+	// normal. Passive data connections are expected to come directly from
+	// the client. If they are also balanced, set PasvAllowForeignPeer.
+	// Optional, defaults to nil which means headers are never expected.
+	ProxyProtocolUpstreams []string
+
+	// Use this option to restrict which IP addresses individual users can log
+	// in from, in addition to AccessList. The key is the username. Users
+	// without an entry can log in from any address. Clients that log in from
+	// an address that isn't allowed receive the same reply as an incorrect
+	// password, so they can't learn which users have rules.
+	UserAccessLists map[string]*IPAccessList
+
+	// Use this option to allow PORT and EPRT to open data connections to
+	// hosts other than the client, for server to server transfers (FXP).
+	// Optional, defaults to false because it makes the server vulnerable to
+	// the FTP bounce attack.
+	AllowFXP bool
+
+	// Use this option to accept passive data connections from any address.
+	// By default only the client's own address may connect to a passive data
+	// socket, so other hosts can't steal the transfer. That can fail when
+	// clients are behind a NAT gateway that uses multiple public IPs.
+	PasvAllowForeignPeer bool
 }
 
 // FTPServer is the root of your FTP application. You should instantiate one
@@ -52,14 +176,44 @@ type FTPServerOpts struct {
 //
 // Always use the NewFTPServer() method to create a new FTPServer.
 type FTPServer struct {
-	serverName       string
-	listenTo         string
-	driverFactory    FTPDriverFactory
-	logger           *ftpLogger
-	pasvMinPort      int
-	pasvMaxPort      int
-	pasvAdvertisedIp string
-	closeChan        chan struct{}
+	serverName           string
+	listenTo             string
+	driverFactory        FTPDriverFactory
+	driverFactoryV2      FTPDriverFactoryV2
+	contextFactory       FTPContextDriverFactory
+	logger               *ftpLogger
+	pasvPorts            *ftpPortPool
+	pasvAddresses        *pasvAddressResolver
+	pasvAddressesErr     error
+	tlsConfig            *tls.Config
+	implicitTLS          bool
+	handshakeTimeout     time.Duration
+	requireTLSForAuth    bool
+	requireTLSForData    bool
+	idleTimeout          time.Duration
+	dataAcceptTimeout    time.Duration
+	stallTimeout         time.Duration
+	maxConnections       int
+	maxConnectionsPerIP  int
+	loginLimiter         LoginLimiter
+	accessList           *IPAccessList
+	proxyUpstreams       *IPAccessList
+	proxyUpstreamsErr    error
+	userAccessLists      map[string]*IPAccessList
+	allowFXP             bool
+	pasvAllowForeignPeer bool
+	commands             commandMap
+	siteCommands         commandMap
+	closeChan            chan struct{}
+	ctx                  context.Context
+	cancel               context.CancelFunc
+	connMutex            sync.Mutex
+	listener             net.Listener
+	conns                map[*ftpConn]struct{}
+	connCount            int
+	connsPerIP           map[string]int
+	connGroup            sync.WaitGroup
+	inShutdown           int32
 }
 
 // serverOptsWithDefaults copies an FTPServerOpts struct into a new struct,
@@ -92,7 +246,37 @@ func serverOptsWithDefaults(opts *FTPServerOpts) *FTPServerOpts {
 	newOpts.PasvMinPort = opts.PasvMinPort
 	newOpts.PasvMaxPort = opts.PasvMaxPort
 	newOpts.PasvAdvertisedIp = opts.PasvAdvertisedIp
+	newOpts.PasvAdvertisedIpByNetwork = opts.PasvAdvertisedIpByNetwork
+	newOpts.PasvAdvertisedIpFunc = opts.PasvAdvertisedIpFunc
+
+	if opts.PasvAdvertisedIpRefresh == 0 {
+		newOpts.PasvAdvertisedIpRefresh = 5 * time.Minute
+	} else {
+		newOpts.PasvAdvertisedIpRefresh = opts.PasvAdvertisedIpRefresh
+	}
 	newOpts.Factory = opts.Factory
+	newOpts.FactoryV2 = opts.FactoryV2
+	newOpts.ContextFactory = opts.ContextFactory
+	newOpts.TLSConfig = opts.TLSConfig
+	newOpts.ImplicitTLS = opts.ImplicitTLS
+	newOpts.RequireTLSForAuth = opts.RequireTLSForAuth
+	newOpts.RequireTLSForData = opts.RequireTLSForData
+	newOpts.IdleTimeout = opts.IdleTimeout
+	newOpts.StallTimeout = opts.StallTimeout
+	newOpts.MaxConnections = opts.MaxConnections
+	newOpts.MaxConnectionsPerIP = opts.MaxConnectionsPerIP
+	newOpts.LoginLimiter = opts.LoginLimiter
+	newOpts.AccessList = opts.AccessList
+	newOpts.ProxyProtocolUpstreams = opts.ProxyProtocolUpstreams
+	newOpts.UserAccessLists = opts.UserAccessLists
+	newOpts.AllowFXP = opts.AllowFXP
+	newOpts.PasvAllowForeignPeer = opts.PasvAllowForeignPeer
+
+	if opts.DataAcceptTimeout == 0 {
+		newOpts.DataAcceptTimeout = 30 * time.Second
+	} else {
+		newOpts.DataAcceptTimeout = opts.DataAcceptTimeout
+	}
 
 	return &newOpts
 }
@@ -120,14 +304,59 @@ func NewFTPServer(opts *FTPServerOpts) *FTPServer {
 	s.listenTo = buildTcpString(opts.Hostname, opts.Port)
 	s.serverName = opts.ServerName
 	s.driverFactory = opts.Factory
+	s.driverFactoryV2 = opts.FactoryV2
+	s.contextFactory = opts.ContextFactory
 	s.logger = newFtpLogger("")
-	s.pasvMinPort = opts.PasvMinPort
-	s.pasvMaxPort = opts.PasvMaxPort
-	s.pasvAdvertisedIp = opts.PasvAdvertisedIp
+	s.pasvPorts = newPortPool(opts.PasvMinPort, opts.PasvMaxPort)
+	s.pasvAddresses, s.pasvAddressesErr = newPasvAddressResolver(opts.PasvAdvertisedIp, opts.PasvAdvertisedIpByNetwork, opts.PasvAdvertisedIpFunc, opts.PasvAdvertisedIpRefresh, s.logger)
+	s.tlsConfig = opts.TLSConfig
+	s.implicitTLS = opts.ImplicitTLS
+	s.handshakeTimeout = tlsHandshakeTimeout
+	s.requireTLSForAuth = opts.RequireTLSForAuth
+	s.requireTLSForData = opts.RequireTLSForData
+	s.idleTimeout = opts.IdleTimeout
+	s.dataAcceptTimeout = opts.DataAcceptTimeout
+	s.stallTimeout = opts.StallTimeout
+	s.maxConnections = opts.MaxConnections
+	s.maxConnectionsPerIP = opts.MaxConnectionsPerIP
+	s.loginLimiter = opts.LoginLimiter
+	s.accessList = opts.AccessList
+	if len(opts.ProxyProtocolUpstreams) > 0 {
+		s.proxyUpstreams, s.proxyUpstreamsErr = NewIPAccessList(opts.ProxyProtocolUpstreams, nil)
+	}
+	s.userAccessLists = opts.UserAccessLists
+	s.allowFXP = opts.AllowFXP
+	s.pasvAllowForeignPeer = opts.PasvAllowForeignPeer
+	s.commands = commandMap{}
+	for name, cmd := range commands {
+		s.commands[name] = cmd
+	}
+	s.siteCommands = commandMap{}
 	s.closeChan = make(chan struct{})
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.conns = make(map[*ftpConn]struct{})
+	s.connsPerIP = make(map[string]int)
 	return s
 }
 
+// RegisterCommand adds a custom command to the server, or replaces one of the
+// built in commands. name is the command clients will send, like "XCRC".
+//
+// Commands must be registered before calling ListenAndServe().
+func (ftpServer *FTPServer) RegisterCommand(name string, cmd FTPCommand) {
+	ftpServer.commands[strings.ToUpper(name)] = customCommand{cmd}
+}
+
+// RegisterSiteCommand adds a custom subcommand of the SITE command to the
+// server. name is the subcommand clients will send, like "CHMOD" for
+// "SITE CHMOD 644 foo.txt". The command will receive the remainder of the
+// line, "644 foo.txt", as its param.
+//
+// Commands must be registered before calling ListenAndServe().
+func (ftpServer *FTPServer) RegisterSiteCommand(name string, cmd FTPCommand) {
+	ftpServer.siteCommands[strings.ToUpper(name)] = customCommand{cmd}
+}
+
 // ListenAndServe asks a new FTPServer to begin accepting client connections. It
 // accepts no arguments - all configuration is provided via the NewFTPServer
 // function.
@@ -137,55 +366,347 @@ func NewFTPServer(opts *FTPServerOpts) *FTPServer {
 // listening on the same port.
 //
 func (ftpServer *FTPServer) ListenAndServe() error {
-	laddr, err := net.ResolveTCPAddr("tcp", ftpServer.listenTo)
-	if err != nil {
+	if err := ftpServer.checkConfig(); err != nil {
 		return err
 	}
-	listener, err := net.ListenTCP("tcp", laddr)
+	listener, err := net.Listen("tcp", ftpServer.listenTo)
 	if err != nil {
 		return err
 	}
+	return ftpServer.Serve(listener)
+}
+
+// Serve accepts client connections on listener, which will be closed when
+// the server stops. Use it instead of ListenAndServe() when the listener is
+// created elsewhere, like a listener on port 0 in tests or one inherited via
+// socket activation. The Hostname and Port options are ignored.
+//
+// Serve blocks until the server is stopped with Close() or Shutdown(), in
+// which case nil is returned, or the listener fails.
+func (ftpServer *FTPServer) Serve(listener net.Listener) error {
+	if err := ftpServer.checkConfig(); err != nil {
+		listener.Close()
+		return err
+	}
+	if !ftpServer.trackListener(listener) {
+		listener.Close()
+		return nil
+	}
 	ftpServer.logger.Printf("listening on %s", listener.Addr().String())
 
+	var retryDelay time.Duration
 	for {
-		select {
-		case <-ftpServer.closeChan:
-			listener.Close()
-			return nil
-		default:
-			listener.SetDeadline(time.Now().Add(2 * time.Second))
-			tcpConn, err := listener.AcceptTCP()
-			if err != nil && strings.HasSuffix(err.Error(), "i/o timeout") {
-				// deadline reached, no big deal
-				// NOTE: This error is passed from the internal/poll/ErrTimeout but that
-				// package is not legal to include, hence the string match. :(
-				continue
-			} else if err != nil {
-				ftpServer.logger.Printf("listening error: %+v", err)
-				return err
+		netConn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ftpServer.closeChan:
+				return nil
+			default:
 			}
-
-			driver, err := ftpServer.driverFactory.NewDriver()
-			if err != nil {
-				ftpServer.logger.Print("Error creating driver, aborting client connection")
-			} else {
-				ftpConn := newftpConn(tcpConn, driver, ftpServer.serverName, ftpServer.pasvMinPort, ftpServer.pasvMaxPort, ftpServer.pasvAdvertisedIp)
-				go ftpConn.Serve()
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// probably out of file descriptors, wait a little and try again
+				if retryDelay == 0 {
+					retryDelay = 5 * time.Millisecond
+				} else if retryDelay < time.Second {
+					retryDelay *= 2
+				}
+				ftpServer.logger.Printf("accept error: %+v, retrying in %s", err, retryDelay)
+				time.Sleep(retryDelay)
+				continue
 			}
+			ftpServer.logger.Printf("listening error: %+v", err)
+			return err
+		}
+		retryDelay = 0
+		ftpServer.handleConn(netConn)
+	}
+}
 
+// handleConn starts a goroutine to serve a newly accepted client connection,
+// if the connection limits allow it. Connections from trusted load balancers
+// have their PROXY protocol header read first, in a separate goroutine so a
+// slow upstream can't hold up the accept loop.
+func (ftpServer *FTPServer) handleConn(netConn net.Conn) {
+	if ftpServer.proxyUpstreams == nil || !ftpServer.proxyUpstreams.Allowed(addrIP(netConn.RemoteAddr())) {
+		ftpServer.serveConn(netConn)
+		return
+	}
+	go func() {
+		conn, err := acceptProxyHeader(netConn)
+		if err != nil {
+			ftpServer.logger.Printf("Error reading PROXY header from %s: %v", addrIP(netConn.RemoteAddr()), err)
+			netConn.Close()
+			return
 		}
+		ftpServer.serveConn(conn)
+	}()
+}
+
+// serveConn starts a goroutine to serve a client connection, after any PROXY
+// protocol header has been read.
+func (ftpServer *FTPServer) serveConn(netConn net.Conn) {
+	var conn net.Conn = netConn
+	if ftpServer.implicitTLS {
+		conn = tls.Server(netConn, ftpServer.tlsConfig)
+	}
+
+	ip := addrIP(netConn.RemoteAddr())
+	if ftpServer.accessList != nil && !ftpServer.accessList.Allowed(ip) {
+		ftpServer.logger.Printf("Access denied, closing connection from %s", ip)
+		conn.Close()
+		return
+	}
+	if !ftpServer.acquireConnSlot(ip) {
+		ftpServer.logger.Printf("Too many connections, rejecting client %s", ip)
+		go rejectConn(conn, 421, "Too many connections")
+		return
+	}
+
+	driver, err := ftpServer.newDriver()
+	if err != nil {
+		ftpServer.logger.Print("Error creating driver, aborting client connection")
+		ftpServer.releaseConnSlot(ip)
+		conn.Close()
+		return
+	}
+	ftpConn := newftpConn(conn, driver, ftpServer)
+	if !ftpServer.trackConn(ftpConn) {
+		ftpServer.releaseConnSlot(ip)
+		conn.Close()
+		return
+	}
+	go func() {
+		defer ftpServer.releaseConnSlot(ip)
+		defer ftpServer.untrackConn(ftpConn)
+		ftpConn.Serve()
+	}()
+}
+
+// rejectConn sends a single reply to a client we don't want to serve, then
+// disconnects them.
+func rejectConn(conn net.Conn, code int, message string) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	fmt.Fprintf(conn, "%d %s\r\n", code, message)
+}
+
+// how long rejectConn() will wait for the client
+const rejectTimeout = 10 * time.Second
+
+// acquireConnSlot reserves a connection for a client from ip, unless the
+// server or the client already have the maximum number of connections open.
+// Slots must be released with releaseConnSlot().
+func (ftpServer *FTPServer) acquireConnSlot(ip string) bool {
+	ftpServer.connMutex.Lock()
+	defer ftpServer.connMutex.Unlock()
+	if ftpServer.maxConnections > 0 && ftpServer.connCount >= ftpServer.maxConnections {
+		return false
+	}
+	if ftpServer.maxConnectionsPerIP > 0 && ftpServer.connsPerIP[ip] >= ftpServer.maxConnectionsPerIP {
+		return false
+	}
+	ftpServer.connCount++
+	ftpServer.connsPerIP[ip]++
+	return true
+}
+
+// releaseConnSlot frees a connection reserved with acquireConnSlot().
+func (ftpServer *FTPServer) releaseConnSlot(ip string) {
+	ftpServer.connMutex.Lock()
+	defer ftpServer.connMutex.Unlock()
+	ftpServer.connCount--
+	ftpServer.connsPerIP[ip]--
+	if ftpServer.connsPerIP[ip] <= 0 {
+		delete(ftpServer.connsPerIP, ip)
+	}
+}
+
+// Addr returns the address the server is listening on, or nil if it isn't
+// listening yet. Useful when listening on port 0, to find the port that was
+// picked.
+func (ftpServer *FTPServer) Addr() net.Addr {
+	ftpServer.connMutex.Lock()
+	defer ftpServer.connMutex.Unlock()
+	if ftpServer.listener == nil {
+		return nil
+	}
+	return ftpServer.listener.Addr()
+}
+
+// PasvPortStats reports how many ports in the PasvMinPort..PasvMaxPort range
+// are in use by passive data sockets. Useful for monitoring, if the range is
+// too small clients will be refused with 425 replies.
+func (ftpServer *FTPServer) PasvPortStats() PasvPortStats {
+	return ftpServer.pasvPorts.Stats()
+}
+
+// checkConfig returns an error if the options provided to NewFTPServer()
+// can't be used together.
+func (ftpServer *FTPServer) checkConfig() error {
+	if ftpServer.implicitTLS && ftpServer.tlsConfig == nil {
+		return errors.New("ImplicitTLS requires a TLSConfig")
+	}
+	if ftpServer.pasvAddressesErr != nil {
+		return ftpServer.pasvAddressesErr
+	}
+	if ftpServer.proxyUpstreamsErr != nil {
+		return ftpServer.proxyUpstreamsErr
+	}
+	if ftpServer.pasvPorts.min > ftpServer.pasvPorts.max {
+		return errors.New("PasvMinPort must not be greater than PasvMaxPort")
+	}
+	if (ftpServer.requireTLSForAuth || ftpServer.requireTLSForData) && ftpServer.tlsConfig == nil {
+		return errors.New("RequireTLSForAuth and RequireTLSForData require a TLSConfig")
 	}
 	return nil
 }
 
-// Close signals the server to stop. It may take a couple of seconds. Do not call ListenAndServe again after this, build a new FTPServer.
+// trackListener records the listener so it can be closed when the server
+// stops. Returns false if the server has already stopped.
+func (ftpServer *FTPServer) trackListener(listener net.Listener) bool {
+	ftpServer.connMutex.Lock()
+	defer ftpServer.connMutex.Unlock()
+	select {
+	case <-ftpServer.closeChan:
+		return false
+	default:
+	}
+	ftpServer.listener = listener
+	return true
+}
+
+// newDriver creates a driver for a new client connection, using whichever
+// factory was provided. FTPDriver and FTPDriverV2 instances are adapted to
+// FTPContextDriver.
+func (ftpServer *FTPServer) newDriver() (FTPContextDriver, error) {
+	if ftpServer.contextFactory != nil {
+		return ftpServer.contextFactory.NewDriver()
+	}
+	if ftpServer.driverFactoryV2 != nil {
+		driver, err := ftpServer.driverFactoryV2.NewDriver()
+		if err != nil {
+			return nil, err
+		}
+		return driverV2Adapter{driver}, nil
+	}
+	driver, err := ftpServer.driverFactory.NewDriver()
+	if err != nil {
+		return nil, err
+	}
+	return driverV2Adapter{driverV1Adapter{driver}}, nil
+}
+
+// Close signals the server to stop. Do not call ListenAndServe or Serve again after this, build a new FTPServer.
+//
+// Every client connection is closed immediately, and any transfers in
+// progress are aborted. Use Shutdown() to let transfers finish first.
 func (ftpServer *FTPServer) Close() {
+	ftpServer.stopAccepting()
+	ftpServer.cancel()
+	for _, conn := range ftpServer.activeConns() {
+		conn.forceClose()
+	}
+}
+
+// Shutdown gracefully stops the server. New connections are refused, idle
+// clients are sent a 421 reply and disconnected, and clients with a transfer
+// in progress are disconnected once it finishes.
+//
+// If ctx expires before every client has been disconnected, the remaining
+// connections are closed as if Close() had been called and the context's
+// error is returned. Either way, Shutdown doesn't return until every
+// connection has been cleaned up.
+func (ftpServer *FTPServer) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&ftpServer.inShutdown, 1)
+	ftpServer.stopAccepting()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if ftpServer.closeIdleConns() {
+			ftpServer.connGroup.Wait()
+			ftpServer.cancel()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			ftpServer.Close()
+			ftpServer.connGroup.Wait()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// how often Shutdown() checks for connections that have become idle
+const shutdownPollInterval = 50 * time.Millisecond
+
+// stopAccepting closes the listener, which stops the loop in Serve() from
+// accepting new connections. Safe to call more than once.
+func (ftpServer *FTPServer) stopAccepting() {
+	ftpServer.connMutex.Lock()
+	defer ftpServer.connMutex.Unlock()
 	select {
 	case <-ftpServer.closeChan:
 	// already closed
 	default:
 		close(ftpServer.closeChan)
+		if ftpServer.listener != nil {
+			ftpServer.listener.Close()
+		}
+	}
+}
+
+// shuttingDown returns true once Shutdown() has been called.
+func (ftpServer *FTPServer) shuttingDown() bool {
+	return atomic.LoadInt32(&ftpServer.inShutdown) == 1
+}
+
+// trackConn records a new client connection so it can be closed when the
+// server stops. Returns false if the server is already stopping, in which
+// case the connection should be dropped.
+func (ftpServer *FTPServer) trackConn(conn *ftpConn) bool {
+	ftpServer.connMutex.Lock()
+	defer ftpServer.connMutex.Unlock()
+	select {
+	case <-ftpServer.closeChan:
+		return false
+	default:
+	}
+	ftpServer.conns[conn] = struct{}{}
+	ftpServer.connGroup.Add(1)
+	return true
+}
+
+// untrackConn is called once a client connection has been cleaned up.
+func (ftpServer *FTPServer) untrackConn(conn *ftpConn) {
+	ftpServer.connMutex.Lock()
+	delete(ftpServer.conns, conn)
+	ftpServer.connMutex.Unlock()
+	ftpServer.connGroup.Done()
+}
+
+// activeConns returns the client connections that are currently open.
+func (ftpServer *FTPServer) activeConns() []*ftpConn {
+	ftpServer.connMutex.Lock()
+	defer ftpServer.connMutex.Unlock()
+	conns := make([]*ftpConn, 0, len(ftpServer.conns))
+	for conn := range ftpServer.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// closeIdleConns closes every connection that isn't busy. Returns true if
+// there are no connections left open.
+func (ftpServer *FTPServer) closeIdleConns() bool {
+	quiet := true
+	for _, conn := range ftpServer.activeConns() {
+		if !conn.closeIfIdle() {
+			quiet = false
+		}
 	}
+	return quiet
 }
 
 func buildTcpString(hostname string, port int) (result string) {
@@ -1,7 +1,19 @@
 package graval
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -88,3 +100,1091 @@ func TestCloseHammer(t *testing.T) {
 
 	})
 }
+
+type testDriver struct {
+	FTPDriverV2
+}
+
+func (driver testDriver) Authenticate(user string, pass string) error {
+	if pass == "secret" {
+		return nil
+	}
+	return ErrPermissionDenied
+}
+
+// the contents of every file downloaded from testDriver
+const testFileContents = "hello world"
+
+func (driver testDriver) GetFile(path string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(testFileContents)), nil
+}
+
+func (driver testDriver) DirContents(path string) ([]os.FileInfo, error) {
+	return []os.FileInfo{NewFileItem("hello.txt", int64(len(testFileContents)), time.Now())}, nil
+}
+
+type testDriverFactory struct{}
+
+func (factory testDriverFactory) NewDriver() (FTPDriverV2, error) {
+	return testDriver{}, nil
+}
+
+// testFactory creates drivers that share the state of driver.
+type testFactory struct {
+	driver FTPDriverV2
+}
+
+func (factory testFactory) NewDriver() (FTPDriverV2, error) {
+	return factory.driver, nil
+}
+
+// testUpload describes a file uploaded to testUploadDriver.
+type testUpload struct {
+	path   string
+	data   string
+	offset int64
+}
+
+// testUploadDriver is a testDriver that records uploads, including resumed
+// uploads.
+type testUploadDriver struct {
+	testDriver
+	uploads chan testUpload
+}
+
+func newTestUploadDriver() testUploadDriver {
+	return testUploadDriver{uploads: make(chan testUpload, 10)}
+}
+
+func (driver testUploadDriver) PutFile(path string, reader io.Reader) error {
+	return driver.PutFileAt(path, reader, 0)
+}
+
+func (driver testUploadDriver) PutFileAt(path string, reader io.Reader, offset int64) error {
+	data, err := ioutil.ReadAll(reader)
+	driver.uploads <- testUpload{path, string(data), offset}
+	return err
+}
+
+// testAppendDriver is a testUploadDriver that also supports APPE.
+type testAppendDriver struct {
+	testUploadDriver
+}
+
+func (driver testAppendDriver) AppendFile(path string, reader io.Reader) error {
+	data, err := ioutil.ReadAll(reader)
+	driver.uploads <- testUpload{path: path, data: string(data)}
+	return err
+}
+
+// testSlowDriver is a testDriver that serves files that never end, slowly.
+type testSlowDriver struct {
+	testDriver
+}
+
+func (driver testSlowDriver) GetFile(path string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(testSlowReader{}), nil
+}
+
+type testSlowReader struct{}
+
+func (reader testSlowReader) Read(p []byte) (int, error) {
+	time.Sleep(10 * time.Millisecond)
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+// testContextDriver is an FTPContextDriver that serves files that never end,
+// by blocking until the context of the transfer is cancelled. The context
+// passed to Authenticate is sent to sessions.
+type testContextDriver struct {
+	FTPContextDriver
+	sessions chan context.Context
+}
+
+func (driver testContextDriver) Authenticate(ctx context.Context, user string, pass string) error {
+	driver.sessions <- ctx
+	return nil
+}
+
+func (driver testContextDriver) GetFile(ctx context.Context, path string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(testContextReader{ctx}), nil
+}
+
+func (driver testContextDriver) NewDriver() (FTPContextDriver, error) {
+	return driver, nil
+}
+
+type testContextReader struct {
+	ctx context.Context
+}
+
+func (reader testContextReader) Read(p []byte) (int, error) {
+	<-reader.ctx.Done()
+	return 0, reader.ctx.Err()
+}
+
+// testShutdownDriver is a testDriver that serves files from newReader, and
+// closes closed when the reader is closed.
+type testShutdownDriver struct {
+	testDriver
+	newReader func() io.Reader
+	closed    chan struct{}
+}
+
+func (driver testShutdownDriver) GetFile(path string) (io.ReadCloser, error) {
+	return testClosingReader{driver.newReader(), driver.closed}, nil
+}
+
+type testClosingReader struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (reader testClosingReader) Close() error {
+	close(reader.closed)
+	return nil
+}
+
+// testPause is a reader that waits before reporting that it's empty.
+type testPause time.Duration
+
+func (pause testPause) Read(p []byte) (int, error) {
+	time.Sleep(time.Duration(pause))
+	return 0, io.EOF
+}
+
+// testLoginLimiter is a LoginLimiter that applies a fixed delay or ban, and
+// sends each call it receives to events.
+type testLoginLimiter struct {
+	delay  time.Duration
+	banned bool
+	events chan string
+}
+
+func newTestLoginLimiter(delay time.Duration, banned bool) testLoginLimiter {
+	return testLoginLimiter{delay, banned, make(chan string, 10)}
+}
+
+func (limiter testLoginLimiter) Check(ip string, user string) (time.Duration, bool) {
+	limiter.events <- "check " + ip + " " + user
+	return limiter.delay, !limiter.banned
+}
+
+func (limiter testLoginLimiter) Failure(ip string, user string) {
+	limiter.events <- "failure " + ip + " " + user
+}
+
+func (limiter testLoginLimiter) Success(ip string, user string) {
+	limiter.events <- "success " + ip + " " + user
+}
+
+// testServer starts a server with opts on a random port, and returns it with
+// the address to connect to.
+func testServer(opts *FTPServerOpts) (*FTPServer, string) {
+	return testServerOn("127.0.0.1:0", opts)
+}
+
+// testServerOn is like testServer, but listens on addr.
+func testServerOn(addr string, opts *FTPServerOpts) (*FTPServer, string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	if opts.FactoryV2 == nil {
+		opts.FactoryV2 = testDriverFactory{}
+	}
+	ftpServer := NewFTPServer(opts)
+	go ftpServer.Serve(listener)
+	return ftpServer, listener.Addr().String()
+}
+
+// testLogin connects to addr and logs in, returning the connection and a
+// reader for the replies.
+func testLogin(addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	conn.Write([]byte("USER bob\r\nPASS secret\r\n"))
+	reader.ReadString('\n')
+	reader.ReadString('\n')
+	return conn, reader
+}
+
+// testCommandReply sends line to the server and returns the reply.
+func testCommandReply(conn net.Conn, reader *bufio.Reader, line string) string {
+	conn.Write([]byte(line + "\r\n"))
+	reply, _ := reader.ReadString('\n')
+	return reply
+}
+
+// testMultilineReply sends line to the server and returns every line of the
+// reply.
+func testMultilineReply(conn net.Conn, reader *bufio.Reader, line string) []string {
+	conn.Write([]byte(line + "\r\n"))
+	lines := []string{}
+	for {
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			return lines
+		}
+		lines = append(lines, strings.TrimRight(reply, "\r\n"))
+		if len(reply) > 3 && reply[3] == ' ' {
+			return lines
+		}
+	}
+}
+
+// testTLSConfig returns a server TLS config with a self signed certificate.
+func testTLSConfig() *tls.Config {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	return &tls.Config{Certificates: server.TLS.Certificates}
+}
+
+// testClientTLSConfig returns a client TLS config that accepts the
+// certificate from testTLSConfig().
+func testClientTLSConfig() *tls.Config {
+	return &tls.Config{InsecureSkipVerify: true}
+}
+
+// testAuthTLS upgrades the control connection with AUTH TLS, and returns the
+// protected connection with a reader for the replies.
+func testAuthTLS(conn net.Conn, reader *bufio.Reader) (net.Conn, *bufio.Reader) {
+	if reply := testCommandReply(conn, reader, "AUTH TLS"); !strings.HasPrefix(reply, "234 ") {
+		panic("AUTH TLS failed: " + reply)
+	}
+	tlsConn := tls.Client(conn, testClientTLSConfig())
+	if err := tlsConn.Handshake(); err != nil {
+		panic(err)
+	}
+	return tlsConn, bufio.NewReader(tlsConn)
+}
+
+// testDataConn opens a passive data connection with EPSV.
+func testDataConn(conn net.Conn, reader *bufio.Reader) net.Conn {
+	reply := testCommandReply(conn, reader, "EPSV")
+	if !strings.HasPrefix(reply, "229 ") {
+		panic("EPSV failed: " + reply)
+	}
+	var port int
+	fmt.Sscanf(reply[strings.Index(reply, "|||")+3:], "%d", &port)
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	data, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestShutdown(t *testing.T) {
+	Convey("Setting up a minimal server, Shutdown() will disconnect idle clients", t, func() {
+		opts := &FTPServerOpts{
+			FactoryV2: testDriverFactory{},
+			Hostname:  "127.0.0.1",
+			Port:      60199,
+		}
+		ftpServer := NewFTPServer(opts)
+		goneChan := make(chan struct{})
+		go func() {
+			defer close(goneChan)
+			ftpServer.ListenAndServe()
+		}()
+		time.Sleep(500 * time.Millisecond)
+
+		conn, err := net.Dial("tcp", "127.0.0.1:60199")
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		welcome, _ := reader.ReadString('\n')
+		So(welcome, ShouldStartWith, "220 ")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		So(ftpServer.Shutdown(ctx), ShouldBeNil)
+
+		goodbye, _ := reader.ReadString('\n')
+		So(goodbye, ShouldStartWith, "421 ")
+		_, err = reader.ReadString('\n')
+		So(err, ShouldNotBeNil)
+		<-goneChan
+	})
+}
+
+func TestShutdownDuringTransfer(t *testing.T) {
+	Convey("Shutdown() lets transfers in progress finish", t, func() {
+		driver := testShutdownDriver{
+			newReader: func() io.Reader {
+				return io.MultiReader(testPause(300*time.Millisecond), strings.NewReader(testFileContents))
+			},
+			closed: make(chan struct{}),
+		}
+		ftpServer, addr := testServer(&FTPServerOpts{FactoryV2: testFactory{driver}})
+		conn, reader := testLogin(addr)
+		defer conn.Close()
+		data := testDataConn(conn, reader)
+		defer data.Close()
+		So(testCommandReply(conn, reader, "RETR hello.txt"), ShouldStartWith, "150 ")
+
+		shutdown := make(chan error)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			shutdown <- ftpServer.Shutdown(ctx)
+		}()
+
+		contents, _ := ioutil.ReadAll(data)
+		So(string(contents), ShouldEqual, testFileContents)
+		reply, _ := reader.ReadString('\n')
+		So(reply, ShouldStartWith, "226 ")
+		goodbye, _ := reader.ReadString('\n')
+		So(goodbye, ShouldStartWith, "421 ")
+		So(<-shutdown, ShouldBeNil)
+	})
+
+	Convey("Shutdown() closes transfers that don't finish in time", t, func() {
+		driver := testShutdownDriver{
+			newReader: func() io.Reader { return testSlowReader{} },
+			closed:    make(chan struct{}),
+		}
+		ftpServer, addr := testServer(&FTPServerOpts{FactoryV2: testFactory{driver}})
+		conn, reader := testLogin(addr)
+		defer conn.Close()
+		data := testDataConn(conn, reader)
+		defer data.Close()
+		So(testCommandReply(conn, reader, "RETR forever.txt"), ShouldStartWith, "150 ")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		So(ftpServer.Shutdown(ctx), ShouldResemble, context.DeadlineExceeded)
+
+		// the transfer has finished, and the driver's reader was closed,
+		// before Shutdown() returned
+		readerClosed := false
+		select {
+		case <-driver.closed:
+			readerClosed = true
+		default:
+		}
+		So(readerClosed, ShouldBeTrue)
+		So(ftpServer.activeConns(), ShouldBeEmpty)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := ioutil.ReadAll(reader)
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestServe(t *testing.T) {
+	Convey("Serving on a listener that was created elsewhere", t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		ftpServer := NewFTPServer(&FTPServerOpts{FactoryV2: testDriverFactory{}})
+		errChan := make(chan error)
+		go func() {
+			errChan <- ftpServer.Serve(listener)
+		}()
+		time.Sleep(100 * time.Millisecond)
+		So(ftpServer.Addr().String(), ShouldEqual, listener.Addr().String())
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		welcome, _ := bufio.NewReader(conn).ReadString('\n')
+		So(welcome, ShouldStartWith, "220 ")
+
+		ftpServer.Close()
+		So(<-errChan, ShouldBeNil)
+		_, err = net.Dial("tcp", listener.Addr().String())
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestIdleTimeout(t *testing.T) {
+	Convey("Clients that don't send anything are disconnected after the idle timeout", t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		ftpServer := NewFTPServer(&FTPServerOpts{
+			FactoryV2:   testDriverFactory{},
+			IdleTimeout: 200 * time.Millisecond,
+		})
+		go ftpServer.Serve(listener)
+		defer ftpServer.Close()
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		welcome, _ := reader.ReadString('\n')
+		So(welcome, ShouldStartWith, "220 ")
+
+		conn.Write([]byte("NOOP\r\n"))
+		noop, _ := reader.ReadString('\n')
+		So(noop, ShouldStartWith, "200 ")
+
+		timeout, _ := reader.ReadString('\n')
+		So(timeout, ShouldEqual, "421 Timeout\r\n")
+		_, err = reader.ReadString('\n')
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestDataTimeouts(t *testing.T) {
+	Convey("Transfers that stall are aborted after the stall timeout", t, func() {
+		driver := newTestUploadDriver()
+		ftpServer, addr := testServer(&FTPServerOpts{
+			FactoryV2:    testFactory{driver},
+			StallTimeout: 200 * time.Millisecond,
+		})
+		defer ftpServer.Close()
+		conn, reader := testLogin(addr)
+		defer conn.Close()
+
+		data := testDataConn(conn, reader)
+		defer data.Close()
+		So(testCommandReply(conn, reader, "STOR b.txt"), ShouldStartWith, "150 ")
+		data.Write([]byte("abc"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply, _ := reader.ReadString('\n')
+		So(reply, ShouldEqual, "426 Data connection timed out; transfer aborted.\r\n")
+		So(<-driver.uploads, ShouldResemble, testUpload{"/b.txt", "abc", 0})
+	})
+
+	Convey("Clients that don't open the passive data connection get an error", t, func() {
+		ftpServer, addr := testServer(&FTPServerOpts{DataAcceptTimeout: 200 * time.Millisecond})
+		defer ftpServer.Close()
+		conn, reader := testLogin(addr)
+		defer conn.Close()
+
+		So(testCommandReply(conn, reader, "EPSV"), ShouldStartWith, "229 ")
+		So(testCommandReply(conn, reader, "RETR hello.txt"), ShouldStartWith, "150 ")
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply, _ := reader.ReadString('\n')
+		So(reply, ShouldStartWith, "425 ")
+	})
+}
+
+func TestLoginLimiter(t *testing.T) {
+	login := func(limiter LoginLimiter, password string) (string, *bufio.Reader) {
+		ftpServer, addr := testServer(&FTPServerOpts{LoginLimiter: limiter})
+		Reset(func() { ftpServer.Close() })
+		conn, err := net.Dial("tcp", addr)
+		So(err, ShouldBeNil)
+		Reset(func() { conn.Close() })
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n')
+		So(testCommandReply(conn, reader, "USER bob"), ShouldStartWith, "331 ")
+		return testCommandReply(conn, reader, "PASS "+password), reader
+	}
+
+	Convey("Logging in with a login limiter", t, func() {
+		Convey("Records successful logins", func() {
+			limiter := newTestLoginLimiter(0, false)
+			reply, _ := login(limiter, "secret")
+			So(reply, ShouldStartWith, "230 ")
+			So(<-limiter.events, ShouldEqual, "check 127.0.0.1 bob")
+			So(<-limiter.events, ShouldEqual, "success 127.0.0.1 bob")
+		})
+
+		Convey("Records failed logins", func() {
+			limiter := newTestLoginLimiter(0, false)
+			reply, _ := login(limiter, "wrong")
+			So(reply, ShouldStartWith, "530 ")
+			So(<-limiter.events, ShouldEqual, "check 127.0.0.1 bob")
+			So(<-limiter.events, ShouldEqual, "failure 127.0.0.1 bob")
+		})
+
+		Convey("Delays checking the password", func() {
+			limiter := newTestLoginLimiter(300*time.Millisecond, false)
+			start := time.Now()
+			reply, _ := login(limiter, "secret")
+			So(reply, ShouldStartWith, "230 ")
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 300*time.Millisecond)
+		})
+
+		Convey("Disconnects banned clients without checking the password", func() {
+			limiter := newTestLoginLimiter(0, true)
+			reply, reader := login(limiter, "secret")
+			So(reply, ShouldStartWith, "421 ")
+			_, err := reader.ReadString('\n')
+			So(err, ShouldEqual, io.EOF)
+			So(<-limiter.events, ShouldEqual, "check 127.0.0.1 bob")
+			So(len(limiter.events), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestUserAccessLists(t *testing.T) {
+	Convey("Users with an access list", t, func() {
+		localhost, err := NewIPAccessList(nil, []string{"127.0.0.1"})
+		So(err, ShouldBeNil)
+		limiter := newTestLoginLimiter(0, false)
+		ftpServer, addr := testServer(&FTPServerOpts{
+			LoginLimiter:    limiter,
+			UserAccessLists: map[string]*IPAccessList{"bob": localhost},
+		})
+		defer ftpServer.Close()
+
+		login := func(user string, password string) string {
+			conn, err := net.Dial("tcp", addr)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			reader.ReadString('\n')
+			testCommandReply(conn, reader, "USER "+user)
+			return testCommandReply(conn, reader, "PASS "+password)
+		}
+
+		Convey("Can't log in from other addresses, and can't tell why", func() {
+			denied := login("bob", "secret")
+			So(denied, ShouldEqual, login("bob", "wrong"))
+			So(denied, ShouldStartWith, "530 ")
+			So(<-limiter.events, ShouldEqual, "check 127.0.0.1 bob")
+			So(<-limiter.events, ShouldEqual, "failure 127.0.0.1 bob")
+		})
+
+		Convey("Don't affect other users", func() {
+			So(login("alice", "secret"), ShouldStartWith, "230 ")
+		})
+	})
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	Convey("Clients that already have too many connections open are rejected", t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		ftpServer := NewFTPServer(&FTPServerOpts{
+			FactoryV2:           testDriverFactory{},
+			MaxConnectionsPerIP: 1,
+		})
+		go ftpServer.Serve(listener)
+		defer ftpServer.Close()
+
+		first, err := net.Dial("tcp", listener.Addr().String())
+		So(err, ShouldBeNil)
+		welcome, _ := bufio.NewReader(first).ReadString('\n')
+		So(welcome, ShouldStartWith, "220 ")
+
+		second, err := net.Dial("tcp", listener.Addr().String())
+		So(err, ShouldBeNil)
+		defer second.Close()
+		rejected, _ := bufio.NewReader(second).ReadString('\n')
+		So(rejected, ShouldEqual, "421 Too many connections\r\n")
+
+		first.Close()
+		time.Sleep(100 * time.Millisecond)
+		third, err := net.Dial("tcp", listener.Addr().String())
+		So(err, ShouldBeNil)
+		defer third.Close()
+		welcome, _ = bufio.NewReader(third).ReadString('\n')
+		So(welcome, ShouldStartWith, "220 ")
+	})
+}
+
+func TestActiveModeTargets(t *testing.T) {
+	Convey("Active data connections", t, func() {
+		Convey("Are refused to other hosts", func() {
+			ftpServer, addr := testServer(&FTPServerOpts{})
+			defer ftpServer.Close()
+			conn, reader := testLogin(addr)
+			defer conn.Close()
+			So(testCommandReply(conn, reader, "PORT 10,0,0,1,200,10"), ShouldStartWith, "504 ")
+			So(testCommandReply(conn, reader, "EPRT |2|::1|51210|"), ShouldStartWith, "504 ")
+		})
+
+		Convey("Are refused to privileged ports", func() {
+			ftpServer, addr := testServer(&FTPServerOpts{AllowFXP: true})
+			defer ftpServer.Close()
+			conn, reader := testLogin(addr)
+			defer conn.Close()
+			So(testCommandReply(conn, reader, "PORT 127,0,0,1,0,25"), ShouldStartWith, "504 ")
+			So(testCommandReply(conn, reader, "EPRT |1|10.0.0.1|22|"), ShouldStartWith, "504 ")
+		})
+
+		Convey("Are refused for unknown network protocols", func() {
+			ftpServer, addr := testServer(&FTPServerOpts{})
+			defer ftpServer.Close()
+			conn, reader := testLogin(addr)
+			defer conn.Close()
+			So(testCommandReply(conn, reader, "EPRT |3|127.0.0.1|51210|"), ShouldStartWith, "522 ")
+		})
+	})
+}
+
+func TestPassiveModeProtocols(t *testing.T) {
+	Convey("Passive data connections over IPv4", t, func() {
+		ftpServer, addr := testServer(&FTPServerOpts{})
+		defer ftpServer.Close()
+		conn, reader := testLogin(addr)
+		defer conn.Close()
+
+		So(testCommandReply(conn, reader, "PASV"), ShouldStartWith, "227 Entering Passive Mode (127,0,0,1,")
+		So(testCommandReply(conn, reader, "EPSV 1"), ShouldStartWith, "229 ")
+		So(testCommandReply(conn, reader, "EPSV 2"), ShouldEqual, "522 Network protocol not supported, use (1)\r\n")
+		So(testCommandReply(conn, reader, "EPSV foo"), ShouldStartWith, "501 ")
+
+		Convey("After EPSV ALL only EPSV is allowed", func() {
+			So(testCommandReply(conn, reader, "EPSV ALL"), ShouldStartWith, "200 ")
+			So(testCommandReply(conn, reader, "PASV"), ShouldStartWith, "503 ")
+			So(testCommandReply(conn, reader, "PORT 127,0,0,1,200,10"), ShouldStartWith, "503 ")
+			So(testCommandReply(conn, reader, "EPRT |1|127.0.0.1|51210|"), ShouldStartWith, "503 ")
+			So(testCommandReply(conn, reader, "EPSV"), ShouldStartWith, "229 ")
+		})
+	})
+
+	Convey("Passive data connections over IPv6", t, func() {
+		if listener, err := net.Listen("tcp", "[::1]:0"); err != nil {
+			t.Skip("IPv6 isn't available")
+		} else {
+			listener.Close()
+		}
+		ftpServer, addr := testServerOn("[::1]:0", &FTPServerOpts{})
+		defer ftpServer.Close()
+		conn, reader := testLogin(addr)
+		defer conn.Close()
+
+		So(testCommandReply(conn, reader, "PASV"), ShouldStartWith, "522 ")
+		So(testCommandReply(conn, reader, "EPSV 1"), ShouldEqual, "522 Network protocol not supported, use (2)\r\n")
+		reply := testCommandReply(conn, reader, "EPSV")
+		So(reply, ShouldStartWith, "229 ")
+
+		var port int
+		fmt.Sscanf(reply[strings.Index(reply, "|||")+3:], "%d", &port)
+		data, err := net.Dial("tcp", net.JoinHostPort("::1", strconv.Itoa(port)))
+		So(err, ShouldBeNil)
+		data.Close()
+	})
+}
+
+func TestImplicitTLSRequiresConfig(t *testing.T) {
+	Convey("Setting up a server with implicit TLS but no TLS config, it will fail to start", t, func() {
+		opts := &FTPServerOpts{
+			ServerName:  "blah blah blah",
+			ImplicitTLS: true,
+		}
+		ftpServer := NewFTPServer(opts)
+		So(ftpServer.ListenAndServe(), ShouldNotBeNil)
+	})
+}
+
+func TestRequireTLSRequiresConfig(t *testing.T) {
+	Convey("Setting up a server that requires TLS but has no TLS config, it will fail to start", t, func() {
+		opts := &FTPServerOpts{
+			ServerName:        "blah blah blah",
+			RequireTLSForAuth: true,
+		}
+		ftpServer := NewFTPServer(opts)
+		So(ftpServer.ListenAndServe(), ShouldNotBeNil)
+	})
+}
+
+func TestExplicitTLS(t *testing.T) {
+	Convey("Clients that upgrade the control connection with AUTH TLS", t, func() {
+		ftpServer, addr := testServer(&FTPServerOpts{TLSConfig: testTLSConfig()})
+		defer ftpServer.Close()
+		plain, err := net.Dial("tcp", addr)
+		So(err, ShouldBeNil)
+		defer plain.Close()
+		reader := bufio.NewReader(plain)
+		reader.ReadString('\n')
+		conn, reader := testAuthTLS(plain, reader)
+
+		Convey("Must send PBSZ before PROT", func() {
+			So(testCommandReply(conn, reader, "PROT P"), ShouldStartWith, "503 ")
+		})
+
+		Convey("Can download files over a protected data connection", func() {
+			So(testCommandReply(conn, reader, "PBSZ 0"), ShouldStartWith, "200 ")
+			So(testCommandReply(conn, reader, "PROT P"), ShouldStartWith, "200 ")
+			So(testCommandReply(conn, reader, "USER bob"), ShouldStartWith, "331 ")
+			So(testCommandReply(conn, reader, "PASS secret"), ShouldStartWith, "230 ")
+
+			data := tls.Client(testDataConn(conn, reader), testClientTLSConfig())
+			defer data.Close()
+			So(testCommandReply(conn, reader, "RETR hello.txt"), ShouldStartWith, "150 ")
+			contents, err := ioutil.ReadAll(data)
+			So(err, ShouldBeNil)
+			So(string(contents), ShouldEqual, testFileContents)
+			So(data.ConnectionState().HandshakeComplete, ShouldBeTrue)
+			reply, _ := reader.ReadString('\n')
+			So(reply, ShouldStartWith, "226 ")
+		})
+	})
+}
+
+func TestImplicitTLS(t *testing.T) {
+	Convey("Clients of a server with implicit TLS", t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		addr := listener.Addr().String()
+		ftpServer := NewFTPServer(&FTPServerOpts{
+			FactoryV2:   testDriverFactory{},
+			TLSConfig:   testTLSConfig(),
+			ImplicitTLS: true,
+		})
+		ftpServer.handshakeTimeout = 100 * time.Millisecond
+		go ftpServer.Serve(listener)
+		defer ftpServer.Close()
+
+		Convey("Are protected from the start", func() {
+			conn, err := tls.Dial("tcp", addr, testClientTLSConfig())
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			welcome, _ := reader.ReadString('\n')
+			So(welcome, ShouldStartWith, "220 ")
+			features := testMultilineReply(conn, reader, "FEAT")
+			So(features, ShouldContain, " PROT")
+			So(features, ShouldNotContain, " AUTH TLS")
+		})
+
+		Convey("Are disconnected if they don't start the handshake", func() {
+			conn, err := net.Dial("tcp", addr)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err = conn.Read(make([]byte, 1))
+			So(err, ShouldEqual, io.EOF)
+		})
+	})
+}
+
+func TestRequireTLS(t *testing.T) {
+	Convey("Servers that require TLS", t, func() {
+		ftpServer, addr := testServer(&FTPServerOpts{
+			TLSConfig:         testTLSConfig(),
+			RequireTLSForAuth: true,
+			RequireTLSForData: true,
+		})
+		defer ftpServer.Close()
+		conn, err := net.Dial("tcp", addr)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n')
+
+		Convey("Refuse to log in over a plain text connection", func() {
+			So(testCommandReply(conn, reader, "USER bob"), ShouldStartWith, "534 ")
+		})
+
+		Convey("Refuse data transfers until PROT P", func() {
+			conn, reader := testAuthTLS(conn, reader)
+			So(testCommandReply(conn, reader, "USER bob"), ShouldStartWith, "331 ")
+			So(testCommandReply(conn, reader, "PASS secret"), ShouldStartWith, "230 ")
+			So(testCommandReply(conn, reader, "PBSZ 0"), ShouldStartWith, "200 ")
+			So(testCommandReply(conn, reader, "RETR hello.txt"), ShouldStartWith, "521 ")
+			So(testCommandReply(conn, reader, "LIST"), ShouldStartWith, "521 ")
+			So(testCommandReply(conn, reader, "PROT C"), ShouldStartWith, "200 ")
+			So(testCommandReply(conn, reader, "RETR hello.txt"), ShouldStartWith, "521 ")
+		})
+	})
+}
+
+func TestRestart(t *testing.T) {
+	Convey("Restarting downloads", t, func() {
+		ftpServer, addr := testServer(&FTPServerOpts{})
+		defer ftpServer.Close()
+		conn, reader := testLogin(addr)
+		defer conn.Close()
+
+		Convey("Skips the start of the file", func() {
+			data := testDataConn(conn, reader)
+			defer data.Close()
+			So(testCommandReply(conn, reader, "REST 6"), ShouldStartWith, "350 ")
+			So(testCommandReply(conn, reader, "RETR hello.txt"), ShouldStartWith, "150 ")
+			contents, _ := ioutil.ReadAll(data)
+			So(string(contents), ShouldEqual, "world")
+			reply, _ := reader.ReadString('\n')
+			So(reply, ShouldStartWith, "226 ")
+		})
+
+		Convey("Is advertised even if the driver can't restart uploads", func() {
+			So(testMultilineReply(conn, reader, "FEAT"), ShouldContain, " REST STREAM")
+			So(testCommandReply(conn, reader, "REST 5"), ShouldStartWith, "350 ")
+			So(testCommandReply(conn, reader, "STOR b.txt"), ShouldStartWith, "554 ")
+		})
+	})
+
+	Convey("Restarting downloads from drivers that can't seek", t, func() {
+		ftpServer, addr := testServer(&FTPServerOpts{FactoryV2: testFactory{testSlowDriver{}}})
+		defer ftpServer.Close()
+		conn, reader := testLogin(addr)
+		defer conn.Close()
+
+		Convey("Skips the start of the file without blocking the session", func() {
+			data := testDataConn(conn, reader)
+			defer data.Close()
+			So(testCommandReply(conn, reader, "REST 1000000000"), ShouldStartWith, "350 ")
+			So(testCommandReply(conn, reader, "RETR forever.txt"), ShouldStartWith, "150 ")
+			So(testCommandReply(conn, reader, "NOOP"), ShouldStartWith, "200 ")
+			So(testCommandReply(conn, reader, "ABOR"), ShouldStartWith, "426 ")
+			reply, _ := reader.ReadString('\n')
+			So(reply, ShouldStartWith, "226 ")
+		})
+	})
+
+	Convey("Restarting uploads", t, func() {
+		driver := newTestUploadDriver()
+		ftpServer, addr := testServer(&FTPServerOpts{FactoryV2: testFactory{driver}})
+		defer ftpServer.Close()
+		conn, reader := testLogin(addr)
+		defer conn.Close()
+
+		upload := func(data net.Conn) testUpload {
+			So(testCommandReply(conn, reader, "STOR b.txt"), ShouldStartWith, "150 ")
+			data.Write([]byte("abc"))
+			data.Close()
+			reply, _ := reader.ReadString('\n')
+			So(reply, ShouldStartWith, "226 ")
+			return <-driver.uploads
+		}
+
+		Convey("Writes the data at the requested offset", func() {
+			data := testDataConn(conn, reader)
+			So(testCommandReply(conn, reader, "REST 5"), ShouldStartWith, "350 ")
+			So(upload(data), ShouldResemble, testUpload{"/b.txt", "abc", 5})
+		})
+
+		Convey("Is cancelled by any other command", func() {
+			data := testDataConn(conn, reader)
+			So(testCommandReply(conn, reader, "REST 5"), ShouldStartWith, "350 ")
+			So(testCommandReply(conn, reader, "NOOP"), ShouldStartWith, "200 ")
+			So(upload(data), ShouldResemble, testUpload{"/b.txt", "abc", 0})
+		})
+
+		Convey("Is advertised", func() {
+			So(testMultilineReply(conn, reader, "FEAT"), ShouldContain, " REST STREAM")
+		})
+	})
+}
+
+func TestAppend(t *testing.T) {
+	Convey("Appending to files", t, func() {
+		Convey("Passes the data to drivers that support it", func() {
+			driver := testAppendDriver{newTestUploadDriver()}
+			ftpServer, addr := testServer(&FTPServerOpts{FactoryV2: testFactory{driver}})
+			defer ftpServer.Close()
+			conn, reader := testLogin(addr)
+			defer conn.Close()
+
+			data := testDataConn(conn, reader)
+			So(testCommandReply(conn, reader, "APPE log.txt"), ShouldStartWith, "150 ")
+			data.Write([]byte("more"))
+			data.Close()
+			reply, _ := reader.ReadString('\n')
+			So(reply, ShouldStartWith, "226 ")
+			So(<-driver.uploads, ShouldResemble, testUpload{path: "/log.txt", data: "more"})
+		})
+
+		Convey("Is refused by drivers that don't support it", func() {
+			ftpServer, addr := testServer(&FTPServerOpts{FactoryV2: testFactory{newTestUploadDriver()}})
+			defer ftpServer.Close()
+			conn, reader := testLogin(addr)
+			defer conn.Close()
+
+			testDataConn(conn, reader).Close()
+			So(testCommandReply(conn, reader, "APPE log.txt"), ShouldStartWith, "502 ")
+		})
+	})
+}
+
+func TestAbort(t *testing.T) {
+	Convey("Aborting transfers", t, func() {
+		ftpServer, addr := testServer(&FTPServerOpts{FactoryV2: testFactory{testSlowDriver{}}})
+		defer ftpServer.Close()
+		conn, reader := testLogin(addr)
+		defer conn.Close()
+
+		Convey("Other commands are answered while a transfer is in progress", func() {
+			data := testDataConn(conn, reader)
+			defer data.Close()
+			So(testCommandReply(conn, reader, "RETR forever.txt"), ShouldStartWith, "150 ")
+			So(testCommandReply(conn, reader, "NOOP"), ShouldStartWith, "200 ")
+			status := testMultilineReply(conn, reader, "STAT")
+			So(status[0], ShouldEqual, "211-FTP server status:")
+			So(strings.Join(status, "\n"), ShouldContainSubstring, " Transfer in progress: RETR forever.txt")
+
+			Convey("And ABOR stops the transfer", func() {
+				So(testCommandReply(conn, reader, "ABOR"), ShouldStartWith, "426 ")
+				reply, _ := reader.ReadString('\n')
+				So(reply, ShouldStartWith, "226 ")
+			})
+		})
+
+		Convey("ABOR without a transfer has nothing to do", func() {
+			So(testCommandReply(conn, reader, "ABOR"), ShouldStartWith, "225 ")
+		})
+	})
+}
+
+func TestContextDriver(t *testing.T) {
+	Convey("Context aware drivers", t, func() {
+		driver := testContextDriver{sessions: make(chan context.Context, 1)}
+		ftpServer, addr := testServer(&FTPServerOpts{ContextFactory: driver})
+		defer ftpServer.Close()
+		conn, reader := testLogin(addr)
+		defer conn.Close()
+		ctx := <-driver.sessions
+
+		Convey("Have downloads cancelled by ABOR", func() {
+			data := testDataConn(conn, reader)
+			defer data.Close()
+			So(testCommandReply(conn, reader, "RETR forever.txt"), ShouldStartWith, "150 ")
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			So(testCommandReply(conn, reader, "ABOR"), ShouldStartWith, "426 ")
+			reply, _ := reader.ReadString('\n')
+			So(reply, ShouldStartWith, "226 ")
+			So(ctx.Err(), ShouldBeNil)
+		})
+
+		Convey("Have the session context cancelled when the client disconnects", func() {
+			So(testCommandReply(conn, reader, "QUIT"), ShouldEqual, "")
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			So(ctx.Err(), ShouldEqual, context.Canceled)
+		})
+	})
+}
+
+func TestStat(t *testing.T) {
+	Convey("The STAT command", t, func() {
+		ftpServer, addr := testServer(&FTPServerOpts{FactoryV2: testFactory{testSlowDriver{}}})
+		defer ftpServer.Close()
+		conn, reader := testLogin(addr)
+		defer conn.Close()
+
+		Convey("Describes the session", func() {
+			status := testMultilineReply(conn, reader, "STAT")
+			So(status[0], ShouldEqual, "211-FTP server status:")
+			So(status, ShouldContain, " Logged in as bob")
+			So(status, ShouldContain, " Data connection: none")
+			So(status[len(status)-1], ShouldEqual, "211 End of status")
+
+			data := testDataConn(conn, reader)
+			defer data.Close()
+			So(testMultilineReply(conn, reader, "STAT"), ShouldContain, " Data connection: passive")
+		})
+
+		Convey("Describes the data connection during a transfer", func() {
+			data := testDataConn(conn, reader)
+			defer data.Close()
+			So(testCommandReply(conn, reader, "RETR forever.txt"), ShouldStartWith, "150 ")
+			So(testMultilineReply(conn, reader, "STAT /"), ShouldContain, " Data connection: passive")
+		})
+
+		Convey("Lists a path over the control connection", func() {
+			status := testMultilineReply(conn, reader, "STAT /")
+			So(status[0], ShouldEqual, "213-Status of /:")
+			So(strings.Join(status, "\n"), ShouldContainSubstring, "hello.txt")
+			So(status[len(status)-1], ShouldEqual, "213 End of status")
+		})
+	})
+}
+
+func TestHelp(t *testing.T) {
+	Convey("The HELP command", t, func() {
+		ftpServer, addr := testServer(&FTPServerOpts{})
+		defer ftpServer.Close()
+		conn, reader := testLogin(addr)
+		defer conn.Close()
+
+		Convey("Lists the supported commands", func() {
+			help := testMultilineReply(conn, reader, "HELP")
+			So(help[0], ShouldEqual, "214-The following commands are recognized:")
+			So(help[1], ShouldStartWith, " ABOR ALLO APPE AUTH")
+			So(strings.Join(help, "\n"), ShouldContainSubstring, " RETR")
+			So(help[len(help)-1], ShouldEqual, "214 Help OK.")
+		})
+
+		Convey("Describes the syntax of a command", func() {
+			So(testCommandReply(conn, reader, "HELP retr"), ShouldEqual, "214 Syntax: RETR <sp> pathname\r\n")
+		})
+
+		Convey("Refuses unknown commands", func() {
+			So(testCommandReply(conn, reader, "HELP xyzzy"), ShouldStartWith, "502 ")
+		})
+	})
+}
+
+type testCommand struct{}
+
+func (cmd testCommand) RequireParam() bool {
+	return false
+}
+
+func (cmd testCommand) RequireAuth() bool {
+	return true
+}
+
+func (cmd testCommand) Syntax() string {
+	return ""
+}
+
+func (cmd testCommand) Execute(session *FTPSession, param string) {
+	session.WriteMessage(200, "OK")
+}
+
+// testCloseCommand disconnects the client from another goroutine, like a
+// driver method running in a transfer would.
+type testCloseCommand struct {
+	testCommand
+}
+
+func (cmd testCloseCommand) Execute(session *FTPSession, param string) {
+	session.WriteMessage(200, "Bye")
+	done := make(chan struct{})
+	go func() {
+		session.Close()
+		close(done)
+	}()
+	<-done
+}
+
+func TestSessionClose(t *testing.T) {
+	Convey("Custom commands can disconnect the client", t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		ftpServer := NewFTPServer(&FTPServerOpts{FactoryV2: testDriverFactory{}})
+		ftpServer.RegisterCommand("XCLS", testCloseCommand{})
+		go ftpServer.Serve(listener)
+		defer ftpServer.Close()
+		conn, reader := testLogin(listener.Addr().String())
+		defer conn.Close()
+
+		So(testCommandReply(conn, reader, "XCLS"), ShouldStartWith, "200 ")
+		_, err = reader.ReadString('\n')
+		So(err, ShouldEqual, io.EOF)
+	})
+}
+
+func TestRegisterCommand(t *testing.T) {
+	Convey("Registering custom commands", t, func() {
+		ftpServer := NewFTPServer(&FTPServerOpts{})
+
+		Convey("Will add new commands to the server", func() {
+			ftpServer.RegisterCommand("xtst", testCommand{})
+			So(ftpServer.commands["XTST"], ShouldResemble, customCommand{testCommand{}})
+		})
+
+		Convey("Will replace built in commands on the server", func() {
+			ftpServer.RegisterCommand("NOOP", testCommand{})
+			So(ftpServer.commands["NOOP"], ShouldResemble, customCommand{testCommand{}})
+		})
+
+		Convey("Will not change the commands on other servers", func() {
+			ftpServer.RegisterCommand("NOOP", testCommand{})
+			So(NewFTPServer(&FTPServerOpts{}).commands["NOOP"], ShouldHaveSameTypeAs, commandNoop{})
+		})
+
+		Convey("Will add SITE commands to the server", func() {
+			ftpServer.RegisterSiteCommand("chmod", testCommand{})
+			So(ftpServer.siteCommands["CHMOD"], ShouldResemble, customCommand{testCommand{}})
+		})
+	})
+}
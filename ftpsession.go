@@ -0,0 +1,120 @@
+package graval
+
+import (
+	"context"
+)
+
+// FTPCommand is the interface that custom commands must implement. Register
+// them with FTPServer.RegisterCommand() or FTPServer.RegisterSiteCommand().
+type FTPCommand interface {
+	// returns - true if the command must be sent with a param
+	RequireParam() bool
+
+	// returns - true if the client must be logged in to use the command
+	RequireAuth() bool
+
+	// returns - a description of the params the command accepts, in the
+	//           style used by RFC 959, like "<sp> pathname". Used by HELP.
+	Syntax() string
+
+	// params  - the session that received the command, the param sent by
+	//           the client
+	Execute(*FTPSession, string)
+}
+
+// FTPSession provides custom commands with access to the state of a single
+// client connection, and allows them to reply to the client.
+type FTPSession struct {
+	conn *ftpConn
+}
+
+func newSession(conn *ftpConn) *FTPSession {
+	session := new(FTPSession)
+	session.conn = conn
+	return session
+}
+
+// Driver returns the driver that was created for this session by the
+// factory. Custom commands will usually type assert it to their own driver
+// type.
+func (session *FTPSession) Driver() interface{} {
+	return driverImplementation(session.conn.driver)
+}
+
+// SessionID returns a random string that uniquely identifies the session in
+// log messages.
+func (session *FTPSession) SessionID() string {
+	return session.conn.sessionId
+}
+
+// User returns the name of the logged in user, or an empty string if the
+// client hasn't logged in yet.
+func (session *FTPSession) User() string {
+	return session.conn.user
+}
+
+// RemoteIP returns the IP address of the client.
+func (session *FTPSession) RemoteIP() string {
+	return session.conn.remoteIP()
+}
+
+// CurrentDir returns the current working directory of the client.
+func (session *FTPSession) CurrentDir() string {
+	return session.conn.namePrefix
+}
+
+// BuildPath converts a path sent by the client into an absolute path, relative
+// to the current working directory if required.
+func (session *FTPSession) BuildPath(path string) string {
+	return session.conn.buildPath(path)
+}
+
+// WriteMessage sends a single line reply to the client, like "200 OK".
+func (session *FTPSession) WriteMessage(code int, message string) error {
+	_, err := session.conn.writeMessage(code, message)
+	return err
+}
+
+// WriteLines sends a multiline reply to the client. The lines must be
+// formatted as described in RFC 959, with the code included. For example:
+//
+//     session.WriteLines(211, "211-Status:", " all good", "211 End")
+//
+func (session *FTPSession) WriteLines(code int, lines ...string) error {
+	_, err := session.conn.writeLines(code, lines...)
+	return err
+}
+
+// Close disconnects the client. It's safe to call from any goroutine,
+// including a driver method that is running a transfer.
+func (session *FTPSession) Close() {
+	session.conn.forceClose()
+}
+
+// sessionContextKey is the key used to store the session in the context that
+// is passed to FTPContextDriver methods.
+type sessionContextKey struct{}
+
+// SessionFromContext returns the session that a context passed to an
+// FTPContextDriver method belongs to. Drivers can use it to find the session
+// ID, user and remote IP of the client.
+func SessionFromContext(ctx context.Context) (*FTPSession, bool) {
+	session, ok := ctx.Value(sessionContextKey{}).(*FTPSession)
+	return session, ok
+}
+
+// Context returns a context that is cancelled when the client disconnects or
+// the server shuts down.
+func (session *FTPSession) Context() context.Context {
+	return session.conn.ctx
+}
+
+// customCommand adapts an FTPCommand so it can be used alongside the built in
+// commands.
+type customCommand struct {
+	FTPCommand
+}
+
+func (cmd customCommand) Execute(conn *ftpConn, param string) {
+	cmd.FTPCommand.Execute(newSession(conn), param)
+}
@@ -0,0 +1,86 @@
+package graval
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// ftpTransfer tracks a data transfer that is running in its own goroutine.
+// The control connection keeps processing commands while the transfer is in
+// progress, so the client can ABOR it.
+type ftpTransfer struct {
+	socket       ftpDataSocket
+	ctx          context.Context
+	cancel       context.CancelFunc
+	description  string
+	stallTimeout time.Duration
+	bytes        int64
+	aborted      int32
+	done         chan struct{}
+}
+
+// newTransfer builds a transfer. description is a human readable summary of
+// the transfer, like "RETR foo.txt". The transfer has its own context, derived
+// from ctx, that is cancelled when the transfer is aborted. The data socket is
+// attached when the transfer starts.
+func newTransfer(ctx context.Context, description string) *ftpTransfer {
+	transfer := new(ftpTransfer)
+	transfer.ctx, transfer.cancel = context.WithCancel(ctx)
+	transfer.description = description
+	transfer.done = make(chan struct{})
+	return transfer
+}
+
+// the standard io.Reader interface, reads from the data socket
+func (transfer *ftpTransfer) Read(p []byte) (n int, err error) {
+	if err = transfer.extendDeadline(); err != nil {
+		return 0, err
+	}
+	n, err = transfer.socket.Read(p)
+	atomic.AddInt64(&transfer.bytes, int64(n))
+	return
+}
+
+// the standard io.Writer interface, writes to the data socket
+func (transfer *ftpTransfer) Write(p []byte) (n int, err error) {
+	if err = transfer.extendDeadline(); err != nil {
+		return 0, err
+	}
+	n, err = transfer.socket.Write(p)
+	atomic.AddInt64(&transfer.bytes, int64(n))
+	return
+}
+
+// extendDeadline gives the next read or write on the data socket stallTimeout
+// to complete, so stalled transfers fail instead of blocking forever.
+func (transfer *ftpTransfer) extendDeadline() error {
+	if transfer.stallTimeout == 0 {
+		return nil
+	}
+	return transfer.socket.SetDeadline(time.Now().Add(transfer.stallTimeout))
+}
+
+// Bytes returns the number of bytes transferred so far
+func (transfer *ftpTransfer) Bytes() int64 {
+	return atomic.LoadInt64(&transfer.bytes)
+}
+
+// Abort cancels the transfer by closing the data socket, which will cause any
+// blocked reads or writes to fail, and cancelling its context.
+func (transfer *ftpTransfer) Abort() {
+	atomic.StoreInt32(&transfer.aborted, 1)
+	transfer.cancel()
+	transfer.socket.Close()
+}
+
+// Aborted returns true if the transfer was cancelled with Abort()
+func (transfer *ftpTransfer) Aborted() bool {
+	return atomic.LoadInt32(&transfer.aborted) == 1
+}
+
+// Wait blocks until the transfer has finished and the final reply has been
+// sent to the client.
+func (transfer *ftpTransfer) Wait() {
+	<-transfer.done
+}
@@ -1,6 +1,6 @@
 module github.com/yob/graval
 
-go 1.12
+go 1.13
 
 require (
 	github.com/jehiah/go-strftime v0.0.0-20171201141054-1d33003b3869
@@ -14,6 +14,7 @@
 package main
 
 import (
+	"context"
 	"github.com/yob/graval"
 	"io"
 	"io/ioutil"
@@ -116,13 +117,17 @@ func main() {
 	}
 	ftpServer := graval.NewFTPServer(opts)
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	signal.Notify(c, os.Interrupt, syscall.SIGQUIT)
 	go func() {
 		<-c
 		log.Println("Exiting...")
-		ftpServer.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := ftpServer.Shutdown(ctx); err != nil {
+			log.Print(err)
+		}
 		os.Exit(1)
 	}()
 
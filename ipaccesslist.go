@@ -0,0 +1,81 @@
+package graval
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IPAccessList restricts which IP addresses can use the server. Rules are
+// written in CIDR notation, like "192.168.0.0/16" or "2001:db8::/32". A
+// single IP address is treated as a network containing just that address.
+//
+// An address that matches a deny rule is always refused. If there are any
+// allow rules, an address must match one of them to be accepted.
+//
+// Always use the NewIPAccessList() method to create a new IPAccessList.
+type IPAccessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewIPAccessList builds an access list from allow and deny rules. Either may
+// be empty. An error is returned if any of the rules can't be parsed.
+func NewIPAccessList(allow []string, deny []string) (*IPAccessList, error) {
+	list := new(IPAccessList)
+	var err error
+	if list.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if list.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func parseCIDRs(rules []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(rules))
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if !strings.Contains(rule, "/") {
+			ip := net.ParseIP(rule)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", rule)
+			}
+			if ip.To4() != nil {
+				rule += "/32"
+			} else {
+				rule += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(rule)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Allowed returns true if ip may use the server. ip is a string like
+// "192.168.1.1", anything that can't be parsed as an IP address is refused.
+func (list *IPAccessList) Allowed(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range list.deny {
+		if ipNet.Contains(parsed) {
+			return false
+		}
+	}
+	if len(list.allow) == 0 {
+		return true
+	}
+	for _, ipNet := range list.allow {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
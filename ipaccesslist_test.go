@@ -0,0 +1,41 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestIPAccessList(t *testing.T) {
+	Convey("An empty list allows everything", t, func() {
+		list, err := NewIPAccessList(nil, nil)
+		So(err, ShouldBeNil)
+		So(list.Allowed("10.0.0.1"), ShouldBeTrue)
+		So(list.Allowed("2001:db8::1"), ShouldBeTrue)
+		So(list.Allowed("not an ip"), ShouldBeFalse)
+	})
+
+	Convey("Allow rules exclude everything else", t, func() {
+		list, err := NewIPAccessList([]string{"10.0.0.0/8", "2001:db8::/32"}, nil)
+		So(err, ShouldBeNil)
+		So(list.Allowed("10.1.2.3"), ShouldBeTrue)
+		So(list.Allowed("::ffff:10.1.2.3"), ShouldBeTrue)
+		So(list.Allowed("2001:db8::1"), ShouldBeTrue)
+		So(list.Allowed("192.168.1.1"), ShouldBeFalse)
+		So(list.Allowed("2001:db9::1"), ShouldBeFalse)
+	})
+
+	Convey("Deny rules take precedence", t, func() {
+		list, err := NewIPAccessList([]string{"10.0.0.0/8"}, []string{"10.0.0.5", "192.168.0.0/16"})
+		So(err, ShouldBeNil)
+		So(list.Allowed("10.0.0.4"), ShouldBeTrue)
+		So(list.Allowed("10.0.0.5"), ShouldBeFalse)
+		So(list.Allowed("192.168.1.1"), ShouldBeFalse)
+	})
+
+	Convey("Invalid rules are an error", t, func() {
+		_, err := NewIPAccessList([]string{"10.0.0.0/33"}, nil)
+		So(err, ShouldNotBeNil)
+		_, err = NewIPAccessList(nil, []string{"bogus"})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -1,12 +1,19 @@
 package graval
 
 import (
+	"fmt"
 	"github.com/jehiah/go-strftime"
+	"hash/fnv"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
+// mlsxFacts are the facts about each file that we can include in MLSD and MLST
+// listings, in the order they're listed. See RFC 3659 for details of each one.
+var mlsxFacts = []string{"type", "size", "modify", "perm", "unique"}
+
 type listFormatter struct {
 	files []os.FileInfo
 }
@@ -44,6 +51,100 @@ func (formatter *listFormatter) Detailed() string {
 	return output
 }
 
+// Machine returns a string that lists the collection of files in the machine
+// readable format used by MLSD, one per line. dir is the directory the files
+// are in, and facts lists the facts to include for each file.
+func (formatter *listFormatter) Machine(dir string, facts []string) string {
+	output := ""
+	for _, file := range formatter.files {
+		fullPath := filepath.Join(dir, file.Name())
+		output += mlsxEntry(file, fullPath, facts) + " " + file.Name() + "\r\n"
+	}
+	return output
+}
+
+// mlsxEntry returns the requested facts about a single file, formatted for an
+// MLSD or MLST listing. fullPath is used to generate the unique fact, as
+// drivers don't have any other way to identify a file.
+func mlsxEntry(file os.FileInfo, fullPath string, facts []string) string {
+	output := ""
+	for _, fact := range facts {
+		switch fact {
+		case "type":
+			if file.IsDir() {
+				output += "type=dir;"
+			} else {
+				output += "type=file;"
+			}
+		case "size":
+			output += "size=" + strconv.FormatInt(file.Size(), 10) + ";"
+		case "modify":
+			output += "modify=" + strftime.Format("%Y%m%d%H%M%S", file.ModTime().UTC()) + ";"
+		case "perm":
+			output += "perm=" + mlsxPerm(file) + ";"
+		case "unique":
+			hash := fnv.New64a()
+			hash.Write([]byte(fullPath))
+			output += fmt.Sprintf("unique=%x;", hash.Sum64())
+		}
+	}
+	return output
+}
+
+// mlsxPerm approximates the perm fact from the owner bits of the file mode,
+// since that's all the driver tells us about permissions.
+func mlsxPerm(file os.FileInfo) (perm string) {
+	mode := file.Mode()
+	if file.IsDir() {
+		if mode&0400 != 0 {
+			perm += "el"
+		}
+		if mode&0200 != 0 {
+			perm += "cdfmp"
+		}
+	} else {
+		if mode&0400 != 0 {
+			perm += "r"
+		}
+		if mode&0200 != 0 {
+			perm += "adfw"
+		}
+	}
+	return
+}
+
+// selectMlsxFacts parses the list of facts requested by a client with
+// OPTS MLST, like "type;size;". Unsupported facts are ignored.
+func selectMlsxFacts(requested string) []string {
+	wanted := map[string]bool{}
+	for _, fact := range strings.Split(requested, ";") {
+		wanted[strings.ToLower(strings.TrimSpace(fact))] = true
+	}
+	facts := []string{}
+	for _, fact := range mlsxFacts {
+		if wanted[fact] {
+			facts = append(facts, fact)
+		}
+	}
+	return facts
+}
+
+// mlstFeature lists the facts we support for the FEAT response, like
+// "type*;size;". Facts that are currently selected are marked with a *.
+func mlstFeature(selected []string) string {
+	output := ""
+	for _, fact := range mlsxFacts {
+		output += fact
+		for _, s := range selected {
+			if s == fact {
+				output += "*"
+			}
+		}
+		output += ";"
+	}
+	return output
+}
+
 func lpad(input string, length int) (result string) {
 	if len(input) < length {
 		result = strings.Repeat(" ", length-len(input)) + input
@@ -54,3 +54,38 @@ func TestDetailedFormat(t *testing.T) {
 		})
 	})
 }
+
+func TestMachineFormat(t *testing.T) {
+	formatter := newListFormatter(files)
+	Convey("The Machine listing format", t, func() {
+		Convey("Will display correctly", func() {
+			So(formatter.Machine("/", []string{"type", "size", "modify"}), ShouldEqual, "type=file;size=99;modify=19700101000001; file1.txt\r\ntype=file;size=99;modify=19700101000001; file1.txt\r\n")
+		})
+
+		Convey("Will display only the requested facts", func() {
+			So(formatter.Machine("/", []string{"size"}), ShouldEqual, "size=99; file1.txt\r\nsize=99; file1.txt\r\n")
+		})
+	})
+}
+
+func TestMachineFacts(t *testing.T) {
+	dirInfo := NewDirItem("dir", time.Unix(1, 0))
+	fileInfo := NewFileItem("one.txt", 10, time.Unix(1, 0))
+	Convey("The facts for MLSD and MLST listings", t, func() {
+		Convey("Will describe directories", func() {
+			So(mlsxEntry(dirInfo, "/dir", []string{"type", "perm"}), ShouldEqual, "type=dir;perm=elcdfmp;")
+		})
+
+		Convey("Will describe files", func() {
+			So(mlsxEntry(fileInfo, "/one.txt", []string{"type", "perm"}), ShouldEqual, "type=file;perm=radfw;")
+		})
+
+		Convey("Will give each path a different unique fact", func() {
+			So(mlsxEntry(fileInfo, "/one.txt", []string{"unique"}), ShouldNotEqual, mlsxEntry(fileInfo, "/two.txt", []string{"unique"}))
+		})
+
+		Convey("Will select requested facts in a consistent order", func() {
+			So(selectMlsxFacts("Size;TYPE;bogus;"), ShouldResemble, []string{"type", "size"})
+		})
+	})
+}
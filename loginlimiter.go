@@ -0,0 +1,226 @@
+package graval
+
+import (
+	"sync"
+	"time"
+)
+
+// LoginLimiter is used to slow down and block clients that repeatedly fail to
+// log in, to protect against password guessing. Provide one to FTPServer via
+// the LoginLimiter option. graval includes an in-memory implementation, see
+// NewMemoryLoginLimiter().
+type LoginLimiter interface {
+	// params  - remote IP, username
+	// returns - how long the client must wait before their password is
+	//           checked, false if the client is banned and may not log in
+	Check(string, string) (time.Duration, bool)
+
+	// params  - remote IP, username
+	// called after a failed login attempt
+	Failure(string, string)
+
+	// params  - remote IP, username
+	// called after a successful login
+	Success(string, string)
+}
+
+// MemoryLoginLimiterOpts contains parameters for graval.NewMemoryLoginLimiter()
+type MemoryLoginLimiterOpts struct {
+	// The number of failed attempts to log in as a single user from a single
+	// IP before the IP is banned from logging in as that user. Optional,
+	// defaults to 5.
+	MaxAttempts int
+
+	// The number of failed attempts to log in as any user from a single IP
+	// before the IP is banned entirely. Optional, defaults to 20.
+	MaxAttemptsPerIP int
+
+	// The delay before checking the password after the first failed attempt.
+	// The delay doubles after every failed attempt. Optional, defaults to 1
+	// second.
+	BaseDelay time.Duration
+
+	// The longest delay before checking the password. Optional, defaults to
+	// 30 seconds.
+	MaxDelay time.Duration
+
+	// Failed attempts are forgotten after this long without another failure.
+	// Optional, defaults to 15 minutes.
+	Window time.Duration
+
+	// How long a ban lasts. Optional, defaults to 15 minutes.
+	BanDuration time.Duration
+
+	// Called whenever a ban starts. user is empty if the IP has been banned
+	// from logging in as any user. Optional.
+	OnBan func(ip string, user string, until time.Time)
+}
+
+// MemoryLoginLimiter is a LoginLimiter that keeps track of failed logins in
+// memory. The history is lost when the process exits, and isn't shared
+// between processes.
+//
+// Always use the NewMemoryLoginLimiter() method to create a new
+// MemoryLoginLimiter.
+type MemoryLoginLimiter struct {
+	opts      MemoryLoginLimiterOpts
+	mutex     sync.Mutex
+	attempts  map[string]*loginAttempts
+	nextPrune time.Time
+	now       func() time.Time
+}
+
+type loginAttempts struct {
+	failures    int
+	lastFailure time.Time
+	bannedUntil time.Time
+}
+
+// NewMemoryLoginLimiter initialises a new MemoryLoginLimiter. Calling this
+// function in your code will probably look something like this:
+//
+//     limiter := graval.NewMemoryLoginLimiter(&graval.MemoryLoginLimiterOpts{
+//       OnBan: func(ip string, user string, until time.Time) {
+//         log.Printf("banned %s (%s) until %s", ip, user, until)
+//       },
+//     })
+//     server  := graval.NewFTPServer(&graval.FTPServerOpts{
+//       Factory: factory,
+//       LoginLimiter: limiter,
+//     })
+//
+func NewMemoryLoginLimiter(opts *MemoryLoginLimiterOpts) *MemoryLoginLimiter {
+	limiter := new(MemoryLoginLimiter)
+	if opts != nil {
+		limiter.opts = *opts
+	}
+	if limiter.opts.MaxAttempts == 0 {
+		limiter.opts.MaxAttempts = 5
+	}
+	if limiter.opts.MaxAttemptsPerIP == 0 {
+		limiter.opts.MaxAttemptsPerIP = 20
+	}
+	if limiter.opts.BaseDelay == 0 {
+		limiter.opts.BaseDelay = time.Second
+	}
+	if limiter.opts.MaxDelay == 0 {
+		limiter.opts.MaxDelay = 30 * time.Second
+	}
+	if limiter.opts.Window == 0 {
+		limiter.opts.Window = 15 * time.Minute
+	}
+	if limiter.opts.BanDuration == 0 {
+		limiter.opts.BanDuration = 15 * time.Minute
+	}
+	limiter.attempts = make(map[string]*loginAttempts)
+	limiter.now = time.Now
+	return limiter
+}
+
+// keys for the attempts map
+func ipKey(ip string) string {
+	return ip
+}
+
+func userKey(ip string, user string) string {
+	return ip + "\x00" + user
+}
+
+// Check implements LoginLimiter
+func (limiter *MemoryLoginLimiter) Check(ip string, user string) (time.Duration, bool) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	now := limiter.now()
+	limiter.prune(now)
+
+	for _, key := range []string{ipKey(ip), userKey(ip, user)} {
+		if attempts := limiter.attempts[key]; attempts != nil && now.Before(attempts.bannedUntil) {
+			return 0, false
+		}
+	}
+
+	attempts := limiter.current(userKey(ip, user), now)
+	if attempts == nil || attempts.failures == 0 {
+		return 0, true
+	}
+	delay := limiter.opts.BaseDelay
+	for i := 1; i < attempts.failures && delay < limiter.opts.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > limiter.opts.MaxDelay {
+		delay = limiter.opts.MaxDelay
+	}
+	return delay, true
+}
+
+// Failure implements LoginLimiter
+func (limiter *MemoryLoginLimiter) Failure(ip string, user string) {
+	limiter.mutex.Lock()
+	now := limiter.now()
+	until := now.Add(limiter.opts.BanDuration)
+	ipBanned := limiter.recordFailure(ipKey(ip), limiter.opts.MaxAttemptsPerIP, now)
+	userBanned := limiter.recordFailure(userKey(ip, user), limiter.opts.MaxAttempts, now)
+	limiter.mutex.Unlock()
+
+	if limiter.opts.OnBan == nil {
+		return
+	}
+	if ipBanned {
+		limiter.opts.OnBan(ip, "", until)
+	}
+	if userBanned {
+		limiter.opts.OnBan(ip, user, until)
+	}
+}
+
+// Success implements LoginLimiter
+func (limiter *MemoryLoginLimiter) Success(ip string, user string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	delete(limiter.attempts, userKey(ip, user))
+}
+
+// current returns the attempts recorded for key, resetting the failure count
+// if the window has passed since the last failure. Must be called with the
+// mutex held.
+func (limiter *MemoryLoginLimiter) current(key string, now time.Time) *loginAttempts {
+	attempts := limiter.attempts[key]
+	if attempts != nil && now.Sub(attempts.lastFailure) > limiter.opts.Window {
+		attempts.failures = 0
+	}
+	return attempts
+}
+
+// recordFailure counts a failed attempt against key, and starts a ban if
+// there have been max failures. Returns true if a ban started. Must be called
+// with the mutex held.
+func (limiter *MemoryLoginLimiter) recordFailure(key string, max int, now time.Time) bool {
+	attempts := limiter.current(key, now)
+	if attempts == nil {
+		attempts = new(loginAttempts)
+		limiter.attempts[key] = attempts
+	}
+	attempts.failures++
+	attempts.lastFailure = now
+	if attempts.failures < max {
+		return false
+	}
+	attempts.failures = 0
+	attempts.bannedUntil = now.Add(limiter.opts.BanDuration)
+	return true
+}
+
+// prune forgets about clients that are no longer banned and haven't failed
+// to log in recently, so the map doesn't grow forever. It runs at most once a
+// minute. Must be called with the mutex held.
+func (limiter *MemoryLoginLimiter) prune(now time.Time) {
+	if now.Before(limiter.nextPrune) {
+		return
+	}
+	limiter.nextPrune = now.Add(time.Minute)
+	for key, attempts := range limiter.attempts {
+		if now.After(attempts.bannedUntil) && now.Sub(attempts.lastFailure) > limiter.opts.Window {
+			delete(limiter.attempts, key)
+		}
+	}
+}
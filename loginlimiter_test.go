@@ -0,0 +1,79 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestMemoryLoginLimiter(t *testing.T) {
+	Convey("Limiting failed logins", t, func() {
+		var bans []string
+		limiter := NewMemoryLoginLimiter(&MemoryLoginLimiterOpts{
+			MaxAttempts:      3,
+			MaxAttemptsPerIP: 5,
+			OnBan: func(ip string, user string, until time.Time) {
+				bans = append(bans, ip+"/"+user)
+			},
+		})
+		now := time.Unix(1000000, 0)
+		limiter.now = func() time.Time { return now }
+
+		Convey("Clients with no failures don't wait", func() {
+			delay, ok := limiter.Check("10.0.0.1", "bob")
+			So(ok, ShouldBeTrue)
+			So(delay, ShouldEqual, 0)
+		})
+
+		Convey("The delay doubles after each failure", func() {
+			limiter.Failure("10.0.0.1", "bob")
+			delay, _ := limiter.Check("10.0.0.1", "bob")
+			So(delay, ShouldEqual, time.Second)
+			limiter.Failure("10.0.0.1", "bob")
+			delay, _ = limiter.Check("10.0.0.1", "bob")
+			So(delay, ShouldEqual, 2*time.Second)
+		})
+
+		Convey("A successful login resets the delay", func() {
+			limiter.Failure("10.0.0.1", "bob")
+			limiter.Success("10.0.0.1", "bob")
+			delay, _ := limiter.Check("10.0.0.1", "bob")
+			So(delay, ShouldEqual, 0)
+		})
+
+		Convey("Failures are forgotten after the window", func() {
+			limiter.Failure("10.0.0.1", "bob")
+			now = now.Add(16 * time.Minute)
+			delay, _ := limiter.Check("10.0.0.1", "bob")
+			So(delay, ShouldEqual, 0)
+		})
+
+		Convey("Too many failures for one user bans the IP from that user", func() {
+			for i := 0; i < 3; i++ {
+				limiter.Failure("10.0.0.1", "bob")
+			}
+			_, ok := limiter.Check("10.0.0.1", "bob")
+			So(ok, ShouldBeFalse)
+			_, ok = limiter.Check("10.0.0.1", "alice")
+			So(ok, ShouldBeTrue)
+			_, ok = limiter.Check("10.0.0.2", "bob")
+			So(ok, ShouldBeTrue)
+			So(bans, ShouldResemble, []string{"10.0.0.1/bob"})
+
+			Convey("Until the ban expires", func() {
+				now = now.Add(16 * time.Minute)
+				_, ok := limiter.Check("10.0.0.1", "bob")
+				So(ok, ShouldBeTrue)
+			})
+		})
+
+		Convey("Too many failures from one IP bans the IP from every user", func() {
+			for _, user := range []string{"a", "b", "c", "d", "e"} {
+				limiter.Failure("10.0.0.1", user)
+			}
+			_, ok := limiter.Check("10.0.0.1", "bob")
+			So(ok, ShouldBeFalse)
+			So(bans, ShouldResemble, []string{"10.0.0.1/"})
+		})
+	})
+}
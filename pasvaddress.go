@@ -0,0 +1,151 @@
+package graval
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errNoIPv4Address is returned when a hostname used as a passive address
+// doesn't have an IPv4 address, which is all PASV can advertise.
+var errNoIPv4Address = errors.New("no IPv4 address found")
+
+// pasvAddressResolver decides which address to advertise to a client in
+// reply to PASV, based on the client's address. Addresses may be hostnames,
+// which are resolved when first used and refreshed in the background.
+type pasvAddressResolver struct {
+	static     string
+	rules      []pasvAddressRule
+	hook       func(string) string
+	refresh    time.Duration
+	mutex      sync.Mutex
+	cache      map[string]resolvedAddress
+	refreshing map[string]bool
+	refreshes  sync.WaitGroup
+	lookup     func(string) ([]net.IP, error)
+	now        func() time.Time
+	logger     *ftpLogger
+}
+
+// pasvAddressRule maps clients in network to address.
+type pasvAddressRule struct {
+	network *net.IPNet
+	address string
+}
+
+// resolvedAddress caches the result of resolving a hostname.
+type resolvedAddress struct {
+	ip      string
+	expires time.Time
+}
+
+// newPasvAddressResolver builds a resolver. static is used for clients that
+// aren't matched by hook or rules, which map CIDR networks to addresses. An
+// error is returned if any of the networks can't be parsed.
+func newPasvAddressResolver(static string, rules map[string]string, hook func(string) string, refresh time.Duration, logger *ftpLogger) (*pasvAddressResolver, error) {
+	resolver := new(pasvAddressResolver)
+	resolver.static = static
+	resolver.hook = hook
+	resolver.refresh = refresh
+	resolver.cache = make(map[string]resolvedAddress)
+	resolver.refreshing = make(map[string]bool)
+	resolver.lookup = net.LookupIP
+	resolver.now = time.Now
+	resolver.logger = logger
+	for cidr, address := range rules {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		resolver.rules = append(resolver.rules, pasvAddressRule{network, address})
+	}
+	// the most specific network wins
+	sort.Slice(resolver.rules, func(i, j int) bool {
+		iOnes, _ := resolver.rules[i].network.Mask.Size()
+		jOnes, _ := resolver.rules[j].network.Mask.Size()
+		return iOnes > jOnes
+	})
+	return resolver, nil
+}
+
+// Address returns the IP address to advertise to a client connecting from
+// remoteIP, or an empty string if the address the server is listening on
+// should be used.
+func (resolver *pasvAddressResolver) Address(remoteIP string) string {
+	address := ""
+	if resolver.hook != nil {
+		address = resolver.hook(remoteIP)
+	}
+	if address == "" {
+		if ip := net.ParseIP(remoteIP); ip != nil {
+			for _, rule := range resolver.rules {
+				if rule.network.Contains(ip) {
+					address = rule.address
+					break
+				}
+			}
+		}
+	}
+	if address == "" {
+		address = resolver.static
+	}
+	if address == "" || net.ParseIP(address) != nil {
+		return address
+	}
+	return resolver.resolve(address)
+}
+
+// resolve returns the IPv4 address of hostname. The first time a hostname is
+// used it is looked up straight away. After that the cached address is
+// returned, and once it is older than the refresh interval it is looked up
+// again in the background so a slow DNS server doesn't hold up clients.
+func (resolver *pasvAddressResolver) resolve(hostname string) string {
+	resolver.mutex.Lock()
+	cached, ok := resolver.cache[hostname]
+	if !ok {
+		resolver.mutex.Unlock()
+		return resolver.refreshHost(hostname)
+	}
+	if !resolver.now().Before(cached.expires) && !resolver.refreshing[hostname] {
+		resolver.refreshing[hostname] = true
+		resolver.refreshes.Add(1)
+		go func() {
+			defer resolver.refreshes.Done()
+			resolver.refreshHost(hostname)
+		}()
+	}
+	resolver.mutex.Unlock()
+	return cached.ip
+}
+
+// refreshHost looks up hostname and caches the result for the refresh
+// interval. If the lookup fails the last known address, if any, is returned.
+func (resolver *pasvAddressResolver) refreshHost(hostname string) string {
+	ip, err := resolver.lookupIPv4(hostname)
+
+	resolver.mutex.Lock()
+	defer resolver.mutex.Unlock()
+	delete(resolver.refreshing, hostname)
+	if err != nil {
+		resolver.logger.Printf("unable to resolve passive address %s: %v", hostname, err)
+		return resolver.cache[hostname].ip
+	}
+	resolver.cache[hostname] = resolvedAddress{ip, resolver.now().Add(resolver.refresh)}
+	return ip
+}
+
+// lookupIPv4 returns the first IPv4 address of hostname.
+func (resolver *pasvAddressResolver) lookupIPv4(hostname string) (string, error) {
+	ips, err := resolver.lookup(hostname)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip.String(), nil
+		}
+	}
+	return "", errNoIPv4Address
+}
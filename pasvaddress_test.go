@@ -0,0 +1,131 @@
+package graval
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPasvAddressResolver(t *testing.T) {
+	logger := newFtpLogger("")
+
+	Convey("With no addresses configured", t, func() {
+		resolver, err := newPasvAddressResolver("", nil, nil, time.Minute, logger)
+		So(err, ShouldBeNil)
+
+		Convey("It advertises the listening address", func() {
+			So(resolver.Address("10.1.2.3"), ShouldEqual, "")
+		})
+	})
+
+	Convey("With addresses for client networks", t, func() {
+		rules := map[string]string{
+			"10.0.0.0/8":  "10.0.0.1",
+			"10.9.0.0/16": "10.9.0.1",
+		}
+		resolver, err := newPasvAddressResolver("203.0.113.1", rules, nil, time.Minute, logger)
+		So(err, ShouldBeNil)
+
+		Convey("It uses the most specific matching network", func() {
+			So(resolver.Address("10.1.2.3"), ShouldEqual, "10.0.0.1")
+			So(resolver.Address("10.9.2.3"), ShouldEqual, "10.9.0.1")
+		})
+
+		Convey("It falls back to the static address", func() {
+			So(resolver.Address("198.51.100.7"), ShouldEqual, "203.0.113.1")
+		})
+	})
+
+	Convey("With an invalid network", t, func() {
+		_, err := newPasvAddressResolver("", map[string]string{"10.0.0.0/99": "10.0.0.1"}, nil, time.Minute, logger)
+
+		Convey("It returns an error", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("With a resolver function", t, func() {
+		hook := func(remoteIP string) string {
+			if remoteIP == "192.0.2.1" {
+				return "192.0.2.254"
+			}
+			return ""
+		}
+		resolver, err := newPasvAddressResolver("203.0.113.1", nil, hook, time.Minute, logger)
+		So(err, ShouldBeNil)
+
+		Convey("It uses the address the function returns", func() {
+			So(resolver.Address("192.0.2.1"), ShouldEqual, "192.0.2.254")
+		})
+
+		Convey("It falls back when the function returns nothing", func() {
+			So(resolver.Address("192.0.2.2"), ShouldEqual, "203.0.113.1")
+		})
+	})
+
+	Convey("With a hostname", t, func() {
+		resolver, err := newPasvAddressResolver("ftp.example.com", nil, nil, time.Minute, logger)
+		So(err, ShouldBeNil)
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		resolver.now = func() time.Time { return now }
+		lookups := 0
+		failing := false
+		resolver.lookup = func(host string) ([]net.IP, error) {
+			lookups++
+			if failing {
+				return nil, errors.New("lookup failed")
+			}
+			return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("198.51.100.1")}, nil
+		}
+
+		Convey("It advertises the IPv4 address of the host", func() {
+			So(resolver.Address("10.1.2.3"), ShouldEqual, "198.51.100.1")
+		})
+
+		Convey("It caches the address until the refresh interval passes", func() {
+			resolver.Address("10.1.2.3")
+			resolver.Address("10.1.2.3")
+			So(lookups, ShouldEqual, 1)
+			now = now.Add(2 * time.Minute)
+			resolver.Address("10.1.2.3")
+			resolver.refreshes.Wait()
+			So(lookups, ShouldEqual, 2)
+		})
+
+		Convey("It serves the cached address while refreshing", func() {
+			resolver.Address("10.1.2.3")
+			release := make(chan struct{})
+			resolver.lookup = func(host string) ([]net.IP, error) {
+				<-release
+				return []net.IP{net.ParseIP("198.51.100.2")}, nil
+			}
+			now = now.Add(2 * time.Minute)
+			So(resolver.Address("10.1.2.3"), ShouldEqual, "198.51.100.1")
+			So(resolver.Address("10.1.2.3"), ShouldEqual, "198.51.100.1")
+			close(release)
+			resolver.refreshes.Wait()
+			So(resolver.Address("10.1.2.3"), ShouldEqual, "198.51.100.2")
+		})
+
+		Convey("It keeps the last address when a refresh fails", func() {
+			resolver.Address("10.1.2.3")
+			failing = true
+			now = now.Add(2 * time.Minute)
+			So(resolver.Address("10.1.2.3"), ShouldEqual, "198.51.100.1")
+			resolver.refreshes.Wait()
+			So(resolver.Address("10.1.2.3"), ShouldEqual, "198.51.100.1")
+		})
+
+		Convey("It falls back when the host has no IPv4 address", func() {
+			resolver.lookup = func(host string) ([]net.IP, error) {
+				return []net.IP{net.ParseIP("2001:db8::1")}, nil
+			}
+			So(resolver.Address("10.1.2.3"), ShouldEqual, "")
+			_, err := resolver.lookupIPv4("ftp.example.com")
+			So(err, ShouldEqual, errNoIPv4Address)
+		})
+	})
+}
@@ -0,0 +1,174 @@
+package graval
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// errInvalidProxyHeader is returned when a connection from a trusted upstream
+// doesn't start with a valid PROXY protocol header.
+var errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// the signature that starts a version 2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// a version 1 header can be at most 107 bytes, including the CRLF
+const proxyV1MaxLength = 107
+
+// how long a trusted upstream has to send the PROXY protocol header
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyConn is a connection received from a load balancer, with the address of
+// the original client taken from the PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	reader     io.Reader
+	remoteAddr net.Addr
+}
+
+// Read reads from the connection, starting with any data that arrived with the
+// header.
+func (conn *proxyConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+// RemoteAddr returns the address of the original client.
+func (conn *proxyConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+// acceptProxyHeader reads the PROXY protocol header (version 1 or 2) from a
+// newly accepted connection, and returns a connection that reports the
+// client's address as its remote address. If the header says the connection
+// was made by the load balancer itself, like a health check, the returned
+// connection reports the load balancer's address.
+func acceptProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	addr, err := readProxyHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	if addr == nil {
+		addr = conn.RemoteAddr()
+	}
+	wrapped := &proxyConn{Conn: conn, reader: conn, remoteAddr: addr}
+	if reader.Buffered() > 0 {
+		wrapped.reader = io.MultiReader(io.LimitReader(reader, int64(reader.Buffered())), conn)
+	}
+	return wrapped, nil
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header. It returns the
+// address of the client, or nil if the header doesn't include one.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	prefix, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch prefix[0] {
+	case 'P':
+		return readProxyV1Header(reader)
+	case proxyV2Signature[0]:
+		return readProxyV2Header(reader)
+	default:
+		return nil, errInvalidProxyHeader
+	}
+}
+
+// readProxyV1Header reads a human readable header, like:
+//
+//     PROXY TCP4 192.0.2.1 198.51.100.1 56324 21\r\n
+//
+func readProxyV1Header(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLength {
+			return nil, errInvalidProxyHeader
+		}
+		c, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, errInvalidProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, errInvalidProxyHeader
+	}
+	srcIP := net.ParseIP(fields[2])
+	dstIP := net.ParseIP(fields[3])
+	srcPort, srcOk := parseDecimal(fields[4], 65535)
+	_, dstOk := parseDecimal(fields[5], 65535)
+	if srcIP == nil || dstIP == nil || !srcOk || !dstOk {
+		return nil, errInvalidProxyHeader
+	}
+	ipv4 := !strings.Contains(fields[2]+fields[3], ":")
+	ipv6 := strings.Contains(fields[2], ":") && strings.Contains(fields[3], ":")
+	if !(fields[1] == "TCP4" && ipv4) && !(fields[1] == "TCP6" && ipv6) {
+		return nil, errInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, nil
+}
+
+// readProxyV2Header reads a binary header, which starts with a 16 byte block
+// containing the signature, command, address family and length of the
+// addresses that follow.
+func readProxyV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, errInvalidProxyHeader
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0:
+		// LOCAL, the load balancer connected on its own behalf
+		return nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, errInvalidProxyHeader
+	}
+	switch family {
+	case 0x11:
+		// TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21:
+		// TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	case 0x00:
+		// unspecified, the client's address isn't known
+		return nil, nil
+	default:
+		return nil, errInvalidProxyHeader
+	}
+}
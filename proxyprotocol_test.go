@@ -0,0 +1,133 @@
+package graval
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testProxyV2Header(command byte, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, byte(len(payload)>>8), byte(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	read := func(header string) (net.Addr, error) {
+		return readProxyHeader(bufio.NewReader(strings.NewReader(header)))
+	}
+
+	Convey("Version 1 headers", t, func() {
+		Convey("Provide the client address over IPv4", func() {
+			addr, err := read("PROXY TCP4 192.0.2.1 198.51.100.1 56324 21\r\n")
+			So(err, ShouldBeNil)
+			So(addr.String(), ShouldEqual, "192.0.2.1:56324")
+		})
+
+		Convey("Provide the client address over IPv6", func() {
+			addr, err := read("PROXY TCP6 2001:db8::1 2001:db8::2 56324 21\r\n")
+			So(err, ShouldBeNil)
+			So(addr.String(), ShouldEqual, "[2001:db8::1]:56324")
+		})
+
+		Convey("Provide no address for unknown connections", func() {
+			addr, err := read("PROXY UNKNOWN\r\n")
+			So(err, ShouldBeNil)
+			So(addr, ShouldBeNil)
+		})
+
+		Convey("Are refused if they are malformed", func() {
+			for _, header := range []string{
+				"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+				"PROXY TCP4 2001:db8::1 2001:db8::2 56324 21\r\n",
+				"PROXY TCP6 192.0.2.1 198.51.100.1 56324 21\r\n",
+				"PROXY TCP4 192.0.2.1 198.51.100.1 65536 21\r\n",
+				"PROXY UDP4 192.0.2.1 198.51.100.1 56324 21\r\n",
+				"PROXY TCP4 192.0.2.1 198.51.100.1 56324 21" + strings.Repeat(" ", 100) + "\r\n",
+			} {
+				_, err := read(header)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+
+	Convey("Version 2 headers", t, func() {
+		Convey("Provide the client address over IPv4", func() {
+			payload := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0, 21}
+			addr, err := read(string(testProxyV2Header(0x1, 0x11, payload)))
+			So(err, ShouldBeNil)
+			So(addr.String(), ShouldEqual, "192.0.2.1:56324")
+		})
+
+		Convey("Provide the client address over IPv6", func() {
+			payload := append(append([]byte{}, net.ParseIP("2001:db8::1")...), net.ParseIP("2001:db8::2")...)
+			payload = append(payload, 0xdc, 0x04, 0, 21)
+			addr, err := read(string(testProxyV2Header(0x1, 0x21, payload)))
+			So(err, ShouldBeNil)
+			So(addr.String(), ShouldEqual, "[2001:db8::1]:56324")
+		})
+
+		Convey("Provide no address for LOCAL connections", func() {
+			addr, err := read(string(testProxyV2Header(0x0, 0x00, nil)))
+			So(err, ShouldBeNil)
+			So(addr, ShouldBeNil)
+		})
+
+		Convey("Are refused if they are malformed", func() {
+			for _, header := range [][]byte{
+				testProxyV2Header(0x1, 0x11, []byte{192, 0, 2, 1}),
+				testProxyV2Header(0x1, 0x12, make([]byte, 12)),
+				testProxyV2Header(0x2, 0x11, make([]byte, 12)),
+				[]byte("\r\n\r\n\x00\r\nQUIT!\x21\x11\x00\x00"),
+			} {
+				_, err := read(string(header))
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func TestProxyProtocol(t *testing.T) {
+	Convey("Connections from trusted load balancers", t, func() {
+		accessList, err := NewIPAccessList(nil, []string{"192.0.2.1"})
+		So(err, ShouldBeNil)
+		ftpServer, addr := testServer(&FTPServerOpts{
+			AccessList:             accessList,
+			ProxyProtocolUpstreams: []string{"127.0.0.1"},
+		})
+		defer ftpServer.Close()
+
+		connect := func(header string) string {
+			conn, err := net.Dial("tcp", addr)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			conn.Write([]byte(header))
+			welcome, _ := bufio.NewReader(conn).ReadString('\n')
+			return welcome
+		}
+
+		Convey("Use the client address from the header", func() {
+			So(connect("PROXY TCP4 198.51.100.1 127.0.0.1 56324 21\r\n"), ShouldStartWith, "220 ")
+			So(connect("PROXY TCP4 192.0.2.1 127.0.0.1 56324 21\r\n"), ShouldEqual, "")
+		})
+
+		Convey("Use the load balancer address for health checks", func() {
+			So(connect(string(testProxyV2Header(0x0, 0x00, nil))), ShouldStartWith, "220 ")
+		})
+
+		Convey("Are closed if they don't send a header", func() {
+			So(connect("USER bob\r\n"), ShouldEqual, "")
+		})
+	})
+
+	Convey("Setting up a server with an invalid load balancer address, it will fail to start", t, func() {
+		ftpServer := NewFTPServer(&FTPServerOpts{
+			FactoryV2:              testDriverFactory{},
+			ProxyProtocolUpstreams: []string{"not an address"},
+		})
+		So(ftpServer.ListenAndServe(), ShouldNotBeNil)
+	})
+}